@@ -0,0 +1,78 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package gokvstore
+
+import "github.com/maneeshchaturvedi/gokvstore/wal"
+
+/*
+WriteBatch collects puts and deletes which are applied to the database atomically by Database.Write.
+The batch is written to the write ahead log as a single entry, so after a crash either all or none
+of its updates are recovered. Unlike Database.Delete, deleting a key in a batch does not check
+whether the key exists.
+
+	batch := new(WriteBatch)
+	batch.Put([]byte("key1"), []byte("value1"))
+	batch.Delete([]byte("key2"))
+	err := db.Write(batch, nil)
+ */
+type WriteBatch struct {
+	records []wal.Record
+}
+
+/*
+Put adds setting the value of key to the batch.
+ */
+func (b *WriteBatch) Put(key, value []byte) {
+	b.records = append(b.records, wal.Record{
+		Type:  wal.TypePut,
+		Key:   key,
+		Value: value,
+	})
+}
+
+/*
+Delete adds deleting key to the batch.
+ */
+func (b *WriteBatch) Delete(key []byte) {
+	b.records = append(b.records, wal.Record{
+		Type: wal.TypeDelete,
+		Key:  key,
+	})
+}
+
+/*
+Clear removes all the updates from the batch, so that it can be reused.
+ */
+func (b *WriteBatch) Clear() {
+	b.records = b.records[:0]
+}
+
+/*
+Len returns the number of updates in the batch.
+ */
+func (b *WriteBatch) Len() int {
+	return len(b.records)
+}
+
+func (b *WriteBatch) validate() error {
+	for _, r := range b.records {
+		if len(r.Key) == 0 {
+			return ErrKeyRequired
+		}
+		if r.Type == wal.TypePut && len(r.Value) == 0 {
+			return ErrValueRequired
+		}
+	}
+	return nil
+}
@@ -0,0 +1,272 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package gokvstore
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"sync"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+	"github.com/pkg/errors"
+)
+
+const (
+	//blockTrailerSize is the size of the trailer appended to every block in the data file.
+	//The trailer records the codec the block was written with, followed by the CRC32C of the
+	//block and the codec, in little endian.
+	blockTrailerSize = 5
+	//noCompressionBlock marks a block which is stored as is.
+	noCompressionBlock byte = 0
+	//snappyCompressionBlock marks a block which is compressed with snappy.
+	snappyCompressionBlock byte = 1
+	//zstdCompressionBlock marks a block which is compressed with zstd.
+	zstdCompressionBlock byte = 2
+	//lz4CompressionBlock marks a block which is compressed with lz4. The compressed data is preceded
+	//by the uncompressed length as a uvarint, since lz4 blocks do not record it.
+	lz4CompressionBlock byte = 3
+	//blockRestartInterval is the number of entries between two restart points of a block. The key of the
+	//entry at a restart point is stored in full, the keys in between only store what they do not share
+	//with the previous key.
+	blockRestartInterval = 16
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	//ErrUnknownCodec is returned when reading a block written with a codec this version does not know.
+	ErrUnknownCodec = errors.New("unknown block codec")
+)
+
+var (
+	zstdDecoderOnce sync.Once
+	zstdDecoder     *zstd.Decoder
+	zstdEncoderLock sync.Mutex
+	zstdEncoders    = make(map[int]*zstd.Encoder)
+)
+
+//zstdEncoderFor returns a shared encoder for the level. Encoders are safe for concurrent use of EncodeAll.
+func zstdEncoderFor(level int) (*zstd.Encoder, error) {
+	zstdEncoderLock.Lock()
+	defer zstdEncoderLock.Unlock()
+	if enc, ok := zstdEncoders[level]; ok {
+		return enc, nil
+	}
+	opts := []zstd.EOption{zstd.WithEncoderConcurrency(1)}
+	if level != 0 {
+		opts = append(opts, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+	}
+	enc, err := zstd.NewWriter(nil, opts...)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create zstd encoder")
+	}
+	zstdEncoders[level] = enc
+	return enc, nil
+}
+
+func getZstdDecoder() *zstd.Decoder {
+	zstdDecoderOnce.Do(func() {
+		zstdDecoder, _ = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	return zstdDecoder
+}
+
+/*
+encodeBlock returns the block as it is written to the data file, followed by its trailer. The block is
+compressed with the codec, unless compression saves less than an eighth of its size, in which case the
+block is stored uncompressed. Readers rely on the trailer rather than the options of the database, so
+blocks written with different codecs can be mixed in an SSTable and across SSTables. Level is only used
+by zstd.
+ */
+func encodeBlock(raw []byte, codec Compression, level int) ([]byte, error) {
+	var compressed []byte
+	var id byte
+	switch codec {
+	case NoCompression:
+	case SnappyCompression:
+		compressed, id = snappy.Encode(nil, raw), snappyCompressionBlock
+	case ZstdCompression:
+		enc, err := zstdEncoderFor(level)
+		if err != nil {
+			return nil, err
+		}
+		compressed, id = enc.EncodeAll(raw, nil), zstdCompressionBlock
+	case LZ4Compression:
+		compressed = make([]byte, binary.MaxVarintLen64+lz4.CompressBlockBound(len(raw)))
+		n := binary.PutUvarint(compressed, uint64(len(raw)))
+		var c lz4.Compressor
+		m, err := c.CompressBlock(raw, compressed[n:])
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to compress data")
+		}
+		//lz4 reports incompressible data by returning 0
+		if m == 0 {
+			compressed = nil
+		} else {
+			compressed, id = compressed[:n+m], lz4CompressionBlock
+		}
+	default:
+		return nil, ErrUnknownCompression
+	}
+	if compressed == nil || len(compressed) >= len(raw)-len(raw)/8 {
+		compressed, id = make([]byte, len(raw), len(raw)+blockTrailerSize), noCompressionBlock
+		copy(compressed, raw)
+	}
+	b := append(compressed, id)
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.Checksum(b, crcTable))
+	return append(b, crc[:]...), nil
+}
+
+/*
+decodeBlock strips the trailer from a block read from the data file and decompresses it if needed.
+The checksum in the trailer is verified first, unless verify is false.
+ */
+func decodeBlock(b []byte, verify bool) (block, error) {
+	if len(b) < blockTrailerSize {
+		return nil, errors.New("block too short for its trailer")
+	}
+	n := len(b) - blockTrailerSize
+	if verify && crc32.Checksum(b[:n+1], crcTable) != binary.LittleEndian.Uint32(b[n+1:]) {
+		return nil, errors.New("block checksum mismatch")
+	}
+	payload := b[:n]
+	switch b[n] {
+	case noCompressionBlock:
+		return payload, nil
+	case snappyCompressionBlock:
+		data, err := snappy.Decode(nil, payload)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to uncompress data")
+		}
+		return data, nil
+	case zstdCompressionBlock:
+		data, err := getZstdDecoder().DecodeAll(payload, nil)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to uncompress data")
+		}
+		return data, nil
+	case lz4CompressionBlock:
+		length, n := binary.Uvarint(payload)
+		//lz4 cannot expand data more than 255 times, so anything larger is corrupt
+		if n <= 0 || length > uint64(len(payload))*255 {
+			return nil, errors.New("failed to uncompress data, bad lz4 length")
+		}
+		data := make([]byte, length)
+		m, err := lz4.UncompressBlock(payload[n:], data)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to uncompress data")
+		}
+		if uint64(m) != length {
+			return nil, errors.New("failed to uncompress data, short lz4 block")
+		}
+		return data, nil
+	}
+	return nil, ErrUnknownCodec
+}
+
+/*
+blockBuilder builds the contents of a data block before it is compressed. Keys are prefix compressed:
+each entry stores the length of the prefix it shares with the previous key, the rest of the key and the
+value, as
+
+	uvarint shared | uvarint unshared | uvarint vallen | key[shared:] | value
+
+Every blockRestartInterval entries the key is stored in full, starting a restart point. The block ends
+with the offsets of the restart points, as uint32 in little endian, followed by their number, so readers
+can binary search the restart points before scanning the entries in between.
+ */
+type blockBuilder struct {
+	buf      []byte
+	restarts []uint32
+	counter  int
+	lastKey  []byte
+	entries  int
+	tmp      [3 * binary.MaxVarintLen64]byte
+}
+
+/*
+add appends a key value pair to the block. Keys must be added in ascending order.
+ */
+func (b *blockBuilder) add(key, value []byte) {
+	shared := 0
+	if b.counter < blockRestartInterval {
+		n := len(b.lastKey)
+		if len(key) < n {
+			n = len(key)
+		}
+		for shared < n && b.lastKey[shared] == key[shared] {
+			shared++
+		}
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.buf)))
+		b.counter = 0
+	}
+	n := binary.PutUvarint(b.tmp[0:], uint64(shared))
+	n += binary.PutUvarint(b.tmp[n:], uint64(len(key)-shared))
+	n += binary.PutUvarint(b.tmp[n:], uint64(len(value)))
+	b.buf = append(b.buf, b.tmp[:n]...)
+	b.buf = append(b.buf, key[shared:]...)
+	b.buf = append(b.buf, value...)
+	b.lastKey = append(b.lastKey[:shared], key[shared:]...)
+	b.counter++
+	b.entries++
+}
+
+/*
+size returns the size of the block once finished.
+ */
+func (b *blockBuilder) size() int {
+	return len(b.buf) + 4*len(b.restarts) + 4
+}
+
+/*
+empty returns whether no entry was added to the block since it was last reset.
+ */
+func (b *blockBuilder) empty() bool {
+	return b.entries == 0
+}
+
+/*
+finish appends the restart points to the block and returns its contents, which are valid until the
+builder is reset.
+ */
+func (b *blockBuilder) finish() []byte {
+	var tmp [4]byte
+	for _, r := range b.restarts {
+		binary.LittleEndian.PutUint32(tmp[:], r)
+		b.buf = append(b.buf, tmp[:]...)
+	}
+	binary.LittleEndian.PutUint32(tmp[:], uint32(len(b.restarts)))
+	return append(b.buf, tmp[:]...)
+}
+
+/*
+reset empties the builder so that it can build the next block.
+ */
+func (b *blockBuilder) reset() {
+	b.buf = b.buf[:0]
+	b.restarts = append(b.restarts[:0], 0)
+	b.counter = 0
+	b.lastKey = b.lastKey[:0]
+	b.entries = 0
+}
+
+func newBlockBuilder() *blockBuilder {
+	b := &blockBuilder{}
+	b.reset()
+	return b
+}
@@ -0,0 +1,151 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package gokvstore
+
+import (
+	"container/list"
+	"encoding/binary"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	//defaultBlockCacheSize is the capacity of the block cache in bytes if the options do not say.
+	defaultBlockCacheSize = 8 << 20
+	//blockCacheShards is the number of shards of the block cache. Each shard has its own lock and LRU list.
+	blockCacheShards = 16
+)
+
+/*
+blockKey identifies a block by the SSTable it belongs to and its offset in the data file.
+ */
+type blockKey struct {
+	table  string
+	offset uint64
+}
+
+type cachedBlock struct {
+	key  blockKey
+	data block
+}
+
+/*
+blockCache holds decompressed blocks of SSTables, up to a capacity in bytes. The cache is split in shards
+by block key, so that readers of different blocks rarely wait on each other. Each shard evicts its least
+recently used blocks when it is full. Cached blocks are shared and must not be modified.
+ */
+type blockCache struct {
+	//hits and misses are updated atomically and come first to be 64 bit aligned
+	hits   uint64
+	misses uint64
+	shards [blockCacheShards]blockCacheShard
+}
+
+type blockCacheShard struct {
+	lock     sync.Mutex
+	capacity int
+	size     int
+	blocks   map[blockKey]*list.Element
+	lru      *list.List
+}
+
+/*
+get returns the cached block, if any.
+ */
+func (c *blockCache) get(key blockKey) (block, bool) {
+	s := c.shard(key)
+	s.lock.Lock()
+	e, ok := s.blocks[key]
+	if ok {
+		s.lru.MoveToFront(e)
+	}
+	s.lock.Unlock()
+	if !ok {
+		atomic.AddUint64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddUint64(&c.hits, 1)
+	return e.Value.(*cachedBlock).data, true
+}
+
+/*
+put adds a block to the cache, evicting the least recently used blocks of its shard to make room.
+Blocks larger than a shard are not cached.
+ */
+func (c *blockCache) put(key blockKey, data block) {
+	s := c.shard(key)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(data) > s.capacity {
+		return
+	}
+	if e, ok := s.blocks[key]; ok {
+		s.lru.MoveToFront(e)
+		return
+	}
+	s.blocks[key] = s.lru.PushFront(&cachedBlock{key, data})
+	s.size += len(data)
+	for s.size > s.capacity {
+		e := s.lru.Back()
+		b := e.Value.(*cachedBlock)
+		s.lru.Remove(e)
+		delete(s.blocks, b.key)
+		s.size -= len(b.data)
+	}
+}
+
+/*
+size returns the number of bytes held by the cache.
+ */
+func (c *blockCache) size() int {
+	n := 0
+	for i := range c.shards {
+		s := &c.shards[i]
+		s.lock.Lock()
+		n += s.size
+		s.lock.Unlock()
+	}
+	return n
+}
+
+func (c *blockCache) shard(key blockKey) *blockCacheShard {
+	var offset [8]byte
+	binary.LittleEndian.PutUint64(offset[:], key.offset)
+	h := fnv.New32a()
+	h.Write([]byte(key.table))
+	h.Write(offset[:])
+	return &c.shards[h.Sum32()%blockCacheShards]
+}
+
+/*
+newBlockCache returns a block cache holding up to capacity bytes of blocks, or nil if capacity is negative.
+ */
+func newBlockCache(capacity int) *blockCache {
+	if capacity < 0 {
+		return nil
+	}
+	if capacity == 0 {
+		capacity = defaultBlockCacheSize
+	}
+	c := &blockCache{}
+	for i := range c.shards {
+		c.shards[i] = blockCacheShard{
+			capacity: capacity / blockCacheShards,
+			blocks:   make(map[blockKey]*list.Element),
+			lru:      list.New(),
+		}
+	}
+	return c
+}
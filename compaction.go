@@ -13,28 +13,66 @@
 package gokvstore
 
 import (
+	"bytes"
 	"fmt"
 	"sort"
-	"path"
-	"io/ioutil"
-	"github.com/tylertreat/BoomFilters"
+	"sync/atomic"
 	"time"
+
+	"github.com/pkg/errors"
 )
 
 const (
+	//minBucketSize is the smallest number of SSTables compacted together
 	minBucketSize = 2
-	maxBucketSize = 8
+	//defaultMaxBucketSize is the largest number of SSTables compacted together if the options do not say
+	defaultMaxBucketSize = 32
+	//defaultBucketLow and defaultBucketHigh bound the size of the SSTables of a bucket, relative to the average
+	//size of the bucket, if the options do not say
+	defaultBucketLow  = 0.5
+	defaultBucketHigh = 1.5
+	//smallTableSize is the size below which SSTables are bucketed together whatever their size, so that the
+	//many small SSTables written by flushes are not spread over buckets by small differences
+	smallTableSize = 1 << 20
+	//defaultCompactionTrigger is the number of SSTables from which the database compacts them if the options do not say
+	defaultCompactionTrigger = 4
 )
 
+//errCompactionStopped is returned by a compaction which was stopped because the database is closing
+var errCompactionStopped = errors.New("compaction stopped")
+
+//ErrDatabaseInUse is returned by Compactor.Compact if the database is open, or being compacted by another Compactor.
+var ErrDatabaseInUse = errors.New("database is in use")
+
+/*
+Compactor merges SSTables together, keeping the newest version of every key. The SSTables are read through
+a table cache, which is shared with the database when the database compacts itself.
+ */
 type Compactor struct {
 	fs      *FileSystem
+	cache   *tableCache
 	files   []string
+	//tables holds all the SSTables from the newest to the oldest, including those which are not compacted
+	tables  []string
+	meta    map[string]tableMeta
 	buckets []*bucket
+	stop    <-chan struct{}
+	err     error
 }
 
 type bucket struct {
 	files     []string
+	size      uint64
 	processed bool
+	//empty holds the SSTables written by the compaction of the bucket which hold no key
+	empty     []string
+}
+
+/*
+average returns the average size of the SSTables of the bucket.
+ */
+func (b *bucket) average() float64 {
+	return float64(b.size) / float64(len(b.files))
 }
 
 type compactionStats struct {
@@ -43,20 +81,39 @@ type compactionStats struct {
 	numKeysBeforeCompaction  uint64
 	numKeysAfterCompaction   uint64
 	timeToCompactBucket      string
+	tombstonesPurged         uint64
+	outputs                  []string
+	props                    []TableProperties
 	err                      error
 }
 
 func (c *Compactor) shouldCompact() bool {
-	if c.files != nil && len(c.files) > minBucketSize {
+	if c.files != nil && len(c.files) >= c.fs.options.minCompactionThreshold() {
 		return true
 	}
 	return false
 }
 
-func (c *Compactor) Compact() {
+/*
+Compact compacts the SSTables of a database which is not open, and deletes the SSTables which were compacted.
+It returns the error of the first compaction which failed, and releases the lock on the database.
+ */
+func (c *Compactor) Compact() (err error) {
+	defer func() {
+		if c.cache != nil {
+			c.cache.close()
+		}
+		if _, cerr := c.fs.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}()
+	if c.err != nil {
+		fmt.Printf("error : %v\n", c.err)
+		return c.err
+	}
 	if !c.shouldCompact() {
 		fmt.Println("Not Enough SSTables to start compaction")
-		return
+		return nil
 	}
 	c.makeBuckets(c.files)
 	done := make(chan interface{})
@@ -67,21 +124,59 @@ func (c *Compactor) Compact() {
 		fmt.Printf("numKeysBeforeCompaction : %d\n", result.numKeysBeforeCompaction)
 		fmt.Printf("numKeysAfterCompaction : %d\n", result.numKeysAfterCompaction)
 		fmt.Printf("timeTakenToCompactBucket : %s\n", result.timeToCompactBucket)
+		fmt.Printf("tombstonesPurged : %d\n", result.tombstonesPurged)
 		fmt.Printf("error : %v\n", result.err)
+		if result.err != nil && err == nil {
+			err = result.err
+		}
 
 	}
-
 	c.deleteProcessedFiles()
-
+	return err
 }
+
+/*
+makeBuckets groups files, which are ordered from the newest to the oldest, in buckets of SSTables of similar
+size, and keeps the buckets which are worth compacting, the most valuable first.
+An SSTable joins the bucket of the SSTable before it if its size is between Options.BucketLow and
+Options.BucketHigh times the average size of the bucket, or if both are small. A bucket only holds SSTables
+which are next to each other in that order, so that a compacted SSTable takes the place of its bucket, and
+at most Options.MaxCompactionThreshold of them. Buckets of less than Options.MinCompactionThreshold SSTables
+are not compacted.
+Compacting many SSTables at once removes the most files and the most overwritten keys, so the buckets with
+the most SSTables are the most valuable, and the smallest of them the cheapest.
+ */
 func (c *Compactor) makeBuckets(files []string) {
-	if len(files) >= minBucketSize && len(files) <= maxBucketSize {
-		b := bucket{files, false}
-		c.buckets = append(c.buckets, &b)
-	} else {
-		c.makeBuckets(files[0 : len(files)/2])
-		c.makeBuckets(files[len(files)/2:])
+	options := c.fs.options
+	low, high := options.bucketLow(), options.bucketHigh()
+	var buckets []*bucket
+	var b *bucket
+	for _, id := range files {
+		size := c.meta[id].size
+		if b != nil && len(b.files) < options.maxCompactionThreshold() {
+			avg := b.average()
+			small := size < smallTableSize && avg < smallTableSize
+			if small || (float64(size) >= avg*low && float64(size) <= avg*high) {
+				b.files = append(b.files, id)
+				b.size += size
+				continue
+			}
+		}
+		b = &bucket{files: []string{id}, size: size}
+		buckets = append(buckets, b)
+	}
+	for _, b := range buckets {
+		if len(b.files) >= options.minCompactionThreshold() {
+			c.buckets = append(c.buckets, b)
+		}
 	}
+	sort.SliceStable(c.buckets, func(i, j int) bool {
+		a, b := c.buckets[i], c.buckets[j]
+		if len(a.files) != len(b.files) {
+			return len(a.files) > len(b.files)
+		}
+		return a.average() < b.average()
+	})
 }
 
 func (c *Compactor) compactBuckets(done <-chan interface{}) (<-chan compactionStats) {
@@ -101,84 +196,580 @@ func (c *Compactor) compactBuckets(done <-chan interface{}) (<-chan compactionSt
 	return results
 }
 
-func (c *Compactor) compactBucket(b *bucket) (cs compactionStats) {
+/*
+stopped returns whether the compaction must stop because the database is closing.
+ */
+func (c *Compactor) stopped() bool {
+	select {
+	case <-c.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+/*
+compactBucket merges the SSTables of the bucket, which are ordered from the newest to the oldest, into a
+new SSTable in level 0.
+ */
+func (c *Compactor) compactBucket(b *bucket) compactionStats {
+	cs := c.compactTables(b.files, olderTables(c.tables, b.files, c.meta), 0, 0)
+	if cs.err == nil {
+		b.processed = true
+		b.empty = cs.emptyOutputs()
+	}
+	return cs
+}
+
+/*
+compactTables merges the SSTables with the ids, which are ordered from the newest to the oldest, into new
+SSTables in level. A new SSTable is started once the data of the current one reaches tableSize, unless
+tableSize is zero. The new SSTables have the largest sequence of their inputs. Only the last of them records
+the SSTables it was compacted from, so the inputs are deleted after a crash only if all of their data was
+written; the SSTables written before it hold nothing which the inputs do not hold. If every key is dropped, the
+last SSTable holds no key and is only written to record the inputs, it is deleted once the inputs are.
+A tombstone is dropped, together with the values it hides, unless one of the older SSTables may hold an older
+value of its key, which it would bring back, or the deleted keys of the SSTable it comes from were deleted within
+the grace period. The new SSTables keep the deletion time of the tombstones they hold.
+ */
+func (c *Compactor) compactTables(files []string, older []tableMeta, level int, tableSize uint64) (cs compactionStats) {
 
 	startTime := time.Now()
-	filter := boom.NewDefaultScalableBloomFilter(0.01)
-	iters := make([]*chunkIterator, 0)
-	sort.Sort(ByTime{b.files, DefaultNameFormat})
-	for _, f := range b.files {
-		fName := path.Join(c.fs.path, f) + dataFileExt
-		data, err := ioutil.ReadFile(fName)
+	tables := make([]*tableIterator, 0)
+	iters := make([]Iterator, 0)
+	//deleted holds the deletion time of every input, tombstones of inputs deleted after purgeBefore are kept
+	deleted := make([]time.Time, 0, len(files))
+	priorities := make([]uint64, 0, len(files))
+	grace := c.fs.options.TombstoneGracePeriod
+	purgeBefore := startTime.Add(-grace)
+	var sequence uint64
+	for _, f := range files {
+		t, err := c.cache.get(f)
 		if err != nil {
 			return compactionStats{err: err}
 		}
-		iter := NewChunkIterator(data)
+		defer c.cache.release(t)
+		props := t.reader.Properties()
+		if props.Sequence > sequence {
+			sequence = props.Sequence
+		}
+		deleted = append(deleted, props.deletionTime())
+		priorities = append(priorities, tablePriority(newTableMeta(props)))
+		iter := newTableIterator(t.reader)
+		tables = append(tables, iter)
 		iters = append(iters, iter)
 	}
-	sst, err := c.fs.NewSSTable()
-	if err != nil {
+
+	var sst *SSTable
+	var w *Writer
+	fail := func(err error) compactionStats {
+		if sst != nil {
+			sst.Close()
+		}
+		for _, id := range cs.outputs {
+			c.fs.DeleteSSTable(id)
+		}
 		return compactionStats{err: err}
 	}
-	w := NewWriter(sst, c.fs.options.UseCompression)
+	//next starts a new SSTable, which is listed as an output before it is written so that it is deleted on failure.
+	//It is written as a single file whatever the options, so that a crash never leaves a half written output
+	next := func() error {
+		var err error
+		if sst, err = c.fs.newSSTable(true); err != nil {
+			sst = nil
+			return err
+		}
+		w = NewWriterWithOptions(sst, c.fs.options)
+		w.props.Sequence = sequence
+		w.props.Level = level
+		cs.outputs = append(cs.outputs, sst.id)
+		return nil
+	}
+	//finish writes the current SSTable to disk
+	finish := func() error {
+		err := w.Close()
+		sst = nil
+		if err != nil {
+			return err
+		}
+		cs.props = append(cs.props, w.props)
+		return nil
+	}
 
-	mergingIter := NewMergingIterator(iters)
-	for mergingIter.Next() {
-		filter.Add(mergingIter.Key())
+	mergingIter := newMergingIterator(iters, priorities)
+	for n := 0; mergingIter.Next(); n++ {
+		if n%1024 == 0 && c.stopped() {
+			mergingIter.Close()
+			return fail(errCompactionStopped)
+		}
+		tombstone := isTombstone(mergingIter.Value())
+		if tombstone && grace >= 0 && !deleted[mergingIter.current].After(purgeBefore) &&
+			!mayContain(older, mergingIter.Key()) {
+			cs.tombstonesPurged++
+			continue
+		}
+		if w != nil && tableSize > 0 && w.offset >= tableSize {
+			if err := finish(); err != nil {
+				mergingIter.Close()
+				return fail(err)
+			}
+			w = nil
+		}
+		if w == nil {
+			if err := next(); err != nil {
+				mergingIter.Close()
+				return fail(err)
+			}
+		}
 		w.Set(mergingIter.Key(), mergingIter.Value())
+		if t := deleted[mergingIter.current]; tombstone && t.After(w.props.DeletionTime) {
+			w.props.DeletionTime = t
+		}
 	}
-	_, err = filter.WriteTo(sst.filterfile)
-	defer sst.filterfile.Close()
-	if err != nil {
-		return compactionStats{err: err}
+	if err := mergingIter.Close(); err != nil {
+		return fail(err)
 	}
-	err = w.Close()
-	if err != nil {
-		return compactionStats{err: err}
+	if w == nil {
+		if err := next(); err != nil {
+			return fail(err)
+		}
+	}
+	w.props.CompactionInputs = files
+	if err := finish(); err != nil {
+		return fail(err)
 	}
 	elapsed := time.Since(startTime)
 	timeTaken := fmt.Sprintf("%s", elapsed)
-	b.processed = true
 	keysBeforeCompaction := uint64(0);
-	for _, iter := range iters {
+	for _, iter := range tables {
 		keysBeforeCompaction += iter.numKeys
 	}
-	stats := compactionStats{
-		numFilesAfterCompaction:  1,
-		numFilesBeforeCompaction: len(b.files),
-		numKeysBeforeCompaction:  keysBeforeCompaction,
-		numKeysAfterCompaction:   mergingIter.numKeysAfterCompaction,
-		timeToCompactBucket:      timeTaken,
-		err:                      nil,
-	}
-	return stats
+	cs.numFilesAfterCompaction = len(cs.outputs)
+	cs.numFilesBeforeCompaction = len(files)
+	cs.numKeysBeforeCompaction = keysBeforeCompaction
+	cs.numKeysAfterCompaction = mergingIter.numKeysAfterCompaction - cs.tombstonesPurged
+	cs.timeToCompactBucket = timeTaken
+	return cs
 
 }
 
+/*
+emptyOutputs returns the SSTables written by the compaction which hold no key, because every key of the
+inputs was dropped.
+ */
+func (cs compactionStats) emptyOutputs() []string {
+	empty := make([]string, 0)
+	for i, id := range cs.outputs {
+		if cs.props[i].NumEntries == 0 {
+			empty = append(empty, id)
+		}
+	}
+	return empty
+}
+
 func (c *Compactor) deleteProcessedFiles() {
 	for _, b := range c.buckets {
 		if b.processed {
 			for _, f := range b.files {
+				c.cache.evict(f)
 				c.fs.DeleteSSTable(f)
 			}
+			for _, f := range b.empty {
+				c.fs.DeleteSSTable(f)
+			}
+		}
+	}
+
+}
+
+/*
+tableMeta is what the database keeps in memory about an SSTable, to order it among the others and to pick it
+for compaction without opening it.
+ */
+type tableMeta struct {
+	level    int
+	sequence uint64
+	minKey   []byte
+	maxKey   []byte
+	size     uint64
+	empty    bool
+}
+
+func newTableMeta(p TableProperties) tableMeta {
+	return tableMeta{
+		level:    p.Level,
+		sequence: p.Sequence,
+		minKey:   p.MinKey,
+		maxKey:   p.MaxKey,
+		size:     p.DataSize,
+		empty:    p.NumEntries == 0,
+	}
+}
+
+/*
+mayContain returns whether the key is within the range of the SSTable.
+ */
+func (m tableMeta) mayContain(key []byte) bool {
+	return !m.empty && bytes.Compare(key, m.minKey) >= 0 && bytes.Compare(key, m.maxKey) <= 0
+}
+
+/*
+overlaps returns whether the range of the SSTable overlaps the range from lo to hi, both inclusive.
+ */
+func (m tableMeta) overlaps(lo, hi []byte) bool {
+	return !m.empty && bytes.Compare(m.minKey, hi) <= 0 && bytes.Compare(m.maxKey, lo) >= 0
+}
+
+/*
+mayContain returns whether the key is within the range of one of the SSTables.
+ */
+func mayContain(tables []tableMeta, key []byte) bool {
+	for _, m := range tables {
+		if m.mayContain(key) {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+olderTables returns what is known of the SSTables which come after the newest of the inputs in tables, ordered
+from the newest to the oldest, without the inputs. They may hold older values of the keys of the inputs.
+ */
+func olderTables(tables, inputs []string, meta map[string]tableMeta) []tableMeta {
+	compacted := make(map[string]bool)
+	for _, id := range inputs {
+		compacted[id] = true
+	}
+	older := make([]tableMeta, 0)
+	found := false
+	for _, id := range tables {
+		if compacted[id] {
+			found = true
+			continue
+		}
+		if !found {
+			continue
+		}
+		older = append(older, meta[id])
+	}
+	return older
+}
+
+/*
+orderTables orders the SSTables with the ids from the newest to the oldest: by level, and by sequence
+within a level. SSTables written before sequences were recorded are older than the others, and ordered by
+name. SSTables of a level past level 0 with the same sequence do not overlap, they are ordered by key.
+ */
+func orderTables(ids []string, meta map[string]tableMeta) {
+	sort.Sort(ByTime{ids, DefaultNameFormat})
+	sort.SliceStable(ids, func(i, j int) bool {
+		a, b := meta[ids[i]], meta[ids[j]]
+		if a.level != b.level {
+			return a.level < b.level
+		}
+		if a.sequence != b.sequence {
+			return a.sequence > b.sequence
 		}
+		return a.level > 0 && bytes.Compare(a.minKey, b.minKey) < 0
+	})
+}
+
+/*
+tablePriority returns the priority of an SSTable when merging it with others, SSTables holding newer data have a
+higher priority: the SSTables of a lower level, and within a level the SSTables with a larger sequence.
+SSTables with the same priority are merged in the order of orderTables.
+ */
+func tablePriority(m tableMeta) uint64 {
+	level := m.level
+	if level >= maxLevels {
+		level = maxLevels - 1
 	}
+	return uint64(maxLevels-1-level)<<56 | m.sequence&(1<<56-1)
+}
 
+/*
+sortTables orders the SSTables with the ids from the newest to the oldest, as orderTables does. SSTables which
+were compacted into one of the others, but were not deleted, for instance because of a crash, are left
+out and returned on their own, followed by the SSTables holding no key left behind by the compactions
+which dropped every key. It also returns what is known of every SSTable and the largest sequence.
+ */
+func sortTables(cache *tableCache, ids []string) (sorted, compacted []string, meta map[string]tableMeta, sequence uint64, err error) {
+	meta = make(map[string]tableMeta)
+	inputs := make(map[string]bool)
+	leftover := make(map[string]bool)
+	for _, id := range ids {
+		t, err := cache.get(id)
+		if err != nil {
+			return nil, nil, nil, 0, err
+		}
+		props := t.reader.Properties()
+		cache.release(t)
+		meta[id] = newTableMeta(props)
+		if props.Sequence > sequence {
+			sequence = props.Sequence
+		}
+		for _, input := range props.CompactionInputs {
+			inputs[input] = true
+		}
+		//a compaction which dropped every key leaves an SSTable holding no key, which is deleted after its inputs
+		if props.NumEntries == 0 && len(props.CompactionInputs) > 0 {
+			leftover[id] = true
+		}
+	}
+	empty := make([]string, 0)
+	for _, id := range ids {
+		if inputs[id] {
+			compacted = append(compacted, id)
+			delete(meta, id)
+		} else if leftover[id] {
+			empty = append(empty, id)
+			delete(meta, id)
+		} else {
+			sorted = append(sorted, id)
+		}
+	}
+	compacted = append(compacted, empty...)
+	orderTables(sorted, meta)
+	return sorted, compacted, meta, sequence, nil
 }
 
+/*
+levelZero returns the SSTables of level 0 out of the SSTables ordered from the newest to the oldest, which
+come first.
+ */
+func levelZero(tables []string, meta map[string]tableMeta) []string {
+	for i, id := range tables {
+		if meta[id].level > 0 {
+			return tables[:i]
+		}
+	}
+	return tables
+}
+
+/*
+NewCompactor returns a Compactor for the SSTables of the database at path, which writes the compacted
+SSTables with the default options.
+ */
 func NewCompactor(path string) *Compactor {
+	return NewCompactorWithOptions(path, DefaultOptions)
+}
 
-	opts := Options{
-		ReadOnly:       false,
-		UseCompression: true,
-		SyncWrite:      false,
+/*
+NewCompactorWithOptions returns a Compactor for the SSTables of the database at path. The compacted SSTables are
+written with the compression selected by options, whatever codec the input tables were written with.
+If options is nil, the default options are used. The SSTables are compacted by size tiered compaction, SSTables
+written by leveled compaction are left as they are.
+An open database compacts its SSTables in the background and keeps its list of SSTables in memory, so it
+does not see the changes made by a Compactor. The Compactor takes the exclusive lock on the database, which
+it holds until Compact returns, and Compact returns ErrDatabaseInUse if the database is open.
+ */
+func NewCompactorWithOptions(path string, options *Options) *Compactor {
+	if options == nil {
+		options = DefaultOptions
 	}
-	fs := NewFS(path, &opts)
-	files := GetDataFiles(path)
+	//the compactor deletes SSTables, so it locks the database as a writer does whatever the options
+	lockOptions := *options
+	lockOptions.ReadOnly = false
+	fs := NewFS(path, &lockOptions)
+	if _, err := fs.OpenDB(); err != nil {
+		if errors.Cause(err) == ErrTimeout {
+			err = ErrDatabaseInUse
+		}
+		return &Compactor{fs: fs, err: err}
+	}
+	cache := newTableCache(fs, options, nil)
+	tables, _, meta, _, err := sortTables(cache, GetDataFiles(path))
 	buckets := make([]*bucket, 0)
 	return &Compactor{
 		fs:      fs,
-		files:   files,
+		cache:   cache,
+		files:   levelZero(tables, meta),
+		tables:  tables,
+		meta:    meta,
 		buckets: buckets,
+		err:     err,
+	}
+}
+
+/*
+minCompactionThreshold returns the smallest number of SSTables of similar size compacted together.
+ */
+func (o *Options) minCompactionThreshold() int {
+	if o.MinCompactionThreshold < minBucketSize {
+		return minBucketSize
+	}
+	return o.MinCompactionThreshold
+}
+
+/*
+maxCompactionThreshold returns the largest number of SSTables compacted together.
+ */
+func (o *Options) maxCompactionThreshold() int {
+	switch {
+	case o.MaxCompactionThreshold == 0:
+		return defaultMaxBucketSize
+	case o.MaxCompactionThreshold < o.minCompactionThreshold():
+		return o.minCompactionThreshold()
+	}
+	return o.MaxCompactionThreshold
+}
+
+func (o *Options) bucketLow() float64 {
+	if o.BucketLow <= 0 {
+		return defaultBucketLow
+	}
+	return o.BucketLow
+}
+
+func (o *Options) bucketHigh() float64 {
+	if o.BucketHigh <= 0 {
+		return defaultBucketHigh
+	}
+	return o.BucketHigh
+}
+
+/*
+compactionTrigger returns the number of SSTables from which the database compacts them, or 0 if the
+database does not compact in the background.
+ */
+func (db *Database) compactionTrigger() int {
+	switch {
+	case db.options.ReadOnly || db.options.CompactionTrigger < 0:
+		return 0
+	case db.options.CompactionTrigger == 0:
+		return defaultCompactionTrigger
+	}
+	if db.options.CompactionTrigger < minBucketSize {
+		return minBucketSize
+	}
+	return db.options.CompactionTrigger
+}
+
+/*
+scheduleCompaction wakes up the background compaction, if it is not already due to run.
+ */
+func (db *Database) scheduleCompaction() {
+	if db.compactions == nil {
+		return
+	}
+	select {
+	case db.compactions <- struct{}{}:
+	default:
+	}
+}
+
+/*
+compactLoop compacts the SSTables of the database whenever it is woken up, until stop is closed.
+ */
+func (db *Database) compactLoop(stop <-chan struct{}) {
+	defer db.compacting.Done()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-db.compactions:
+			db.compact(stop)
+		}
+	}
+}
+
+/*
+compact compacts the SSTables of the database if there are enough of them, in the compaction style selected
+by the options. Each compaction replaces the SSTables it compacted with its own in the list of SSTables, and
+deletes them. Reads and flushes go on while the SSTables are compacted.
+ */
+func (db *Database) compact(stop <-chan struct{}) {
+	if db.options.CompactionStyle == LeveledCompaction {
+		db.compactLevels(stop)
+		return
+	}
+	if tables, meta := db.currentState(); len(levelZero(tables, meta)) < db.compactionTrigger() {
+		return
+	}
+	//each compaction makes a larger SSTable, which may be bucketed with others of its size in turn
+	for compacted := true; compacted; {
+		compacted = false
+		tables, meta := db.currentState()
+		//SSTables written by leveled compaction are left as they are
+		c := &Compactor{
+			fs:     db.fs,
+			cache:  db.cache,
+			files:  levelZero(tables, meta),
+			tables: tables,
+			meta:   meta,
+			stop:   stop,
+		}
+		c.makeBuckets(c.files)
+		for _, b := range c.buckets {
+			if !db.compacted(b.files, c.compactBucket(b)) {
+				return
+			}
+			compacted = true
+		}
+	}
+}
+
+/*
+compacted installs a compaction of the SSTables with the ids and counts it. It returns false if the
+compaction failed or was stopped.
+ */
+func (db *Database) compacted(inputs []string, cs compactionStats) bool {
+	if cs.err == errCompactionStopped {
+		return false
+	}
+	if cs.err != nil {
+		atomic.AddUint64(&db.compactionErrors, 1)
+		return false
+	}
+	db.installCompaction(inputs, cs.outputs, cs.props)
+	atomic.AddUint64(&db.compactionCount, 1)
+	atomic.AddUint64(&db.tombstonesPurged, cs.tombstonesPurged)
+	return true
+}
+
+/*
+installCompaction replaces the SSTables which were compacted with the compacted SSTables, and deletes them.
+The compacted SSTables are ordered among the others by their level and sequence. A compacted SSTable which
+holds no key is left out, and deleted once the SSTables it was compacted from are.
+ */
+func (db *Database) installCompaction(inputs, outputs []string, props []TableProperties) {
+	compacted := make(map[string]bool)
+	for _, id := range inputs {
+		compacted[id] = true
+	}
+	db.rlock.Lock()
+	tables := make([]string, 0, len(db.tables)+len(outputs))
+	meta := make(map[string]tableMeta, len(db.meta)+len(outputs))
+	for _, id := range db.tables {
+		if !compacted[id] {
+			tables = append(tables, id)
+			meta[id] = db.meta[id]
+		}
+	}
+	empty := make([]string, 0)
+	for i, id := range outputs {
+		if props[i].NumEntries == 0 {
+			empty = append(empty, id)
+			continue
+		}
+		tables = append(tables, id)
+		meta[id] = newTableMeta(props[i])
+	}
+	orderTables(tables, meta)
+	db.tables, db.meta = tables, meta
+	db.rlock.Unlock()
+
+	//readers which took the list of SSTables before it changed may still open the inputs
+	db.readers.Lock()
+	for _, id := range inputs {
+		db.cache.evict(id)
+	}
+	db.readers.Unlock()
+	for _, id := range inputs {
+		db.fs.DeleteSSTable(id)
+	}
+	for _, id := range empty {
+		db.fs.DeleteSSTable(id)
 	}
 }
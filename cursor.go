@@ -13,12 +13,13 @@
 package gokvstore
 
 /*
-Cursor allows a client to iterate over a range of keys. Keys are returned in ascending order,
-starting with the lowest to the highest key.
+Cursor allows a client to iterate over a range of keys. Next returns keys in ascending order,
+starting with the lowest to the highest key, and Prev returns them in descending order, starting
+with the highest key. A Cursor is a thin adapter over an Iterator, kept
+for compatibility; the keys are read lazily as the cursor advances.
  */
 type Cursor struct {
-	data        []data
-	currPointer int
+	iter Iterator
 }
 
 type data struct {
@@ -27,38 +28,48 @@ type data struct {
 }
 
 /*
-Next is used to sequentially traverse over the records in the cursor.
+Next is used to sequentially traverse over the records in the cursor. The first call to Next
+moves the cursor to the first record.
  */
 func (cursor *Cursor) Next() (hasNext bool) {
-	cursor.currPointer++
-	return cursor.currPointer < len(cursor.data)
+	return cursor.iter.Next()
 }
+
+/*
+Prev is used to traverse over the records in the cursor in reverse. The first call to Prev
+moves the cursor to the last record.
+ */
+func (cursor *Cursor) Prev() (hasPrev bool) {
+	return cursor.iter.Prev()
+}
+
 /*
 Key returns the current key which the cursor points to.
  */
 func (cursor *Cursor) Key() (key []byte) {
-	return cursor.data[cursor.currPointer].key
+	return cursor.iter.Key()
 }
+
 /*
 Value returns the value associated with the current key.
  */
 func (cursor *Cursor) Value() (value []byte) {
-	return cursor.data[cursor.currPointer].value
+	return cursor.iter.Value()
 }
+
 /*
-Close closes the Cursor and discards the data associated with the Cursor.
+Close closes the Cursor and releases the underlying iterator.
  */
 func (cursor *Cursor) Close() {
-	cursor.data = nil
-	cursor.currPointer = 0
+	cursor.iter.Close()
 }
+
 /*
-NewCursor creates a new cursor, containing the data that is passed in.
+NewCursor creates a new cursor over the iterator that is passed in.
  */
-func NewCursor(data []data) *Cursor {
+func NewCursor(iter Iterator) *Cursor {
 
 	return &Cursor{
-		data:        data,
-		currPointer: 0,
+		iter: iter,
 	}
 }
@@ -1,17 +1,15 @@
 package gokvstore
 
 import (
-	"os"
-	"path"
+	"math"
 	"path/filepath"
-	"sort"
 	"sync"
+	"sync/atomic"
 
 	"bytes"
 	"github.com/maneeshchaturvedi/gokvstore/memfs"
+	"github.com/maneeshchaturvedi/gokvstore/wal"
 	"github.com/pkg/errors"
-	"github.com/tylertreat/BoomFilters"
-	"strings"
 )
 
 const (
@@ -49,8 +47,13 @@ var (
 	ErrDeleteFailed     = errors.New("failed to delete key")
 	//ErrInvalidRange is returned if the start key is larger than the end keys
 	ErrInvalidRange     = errors.New("endKey should be greater than startKey")
-	//ErrRangeError is returned if the start and end key are not present in the same SSTable
+	//ErrRangeError was returned if the start and end key were not present in the same SSTable.
+	//Range now spans all the SSTables and no longer returns it.
 	ErrRangeError       = errors.New("endKey and startkey should be in the same segment")
+	//ErrUnknownCompression is returned by Open if the options specify a compression it does not know.
+	ErrUnknownCompression = errors.New("unknown compression")
+	//ErrUnknownCompactionStyle is returned by Open if the options specify a compaction style it does not know.
+	ErrUnknownCompactionStyle = errors.New("unknown compaction style")
 )
 /*
 The database struct is what the client uses to work with the database. The client would
@@ -99,8 +102,28 @@ type Database struct {
 	rlock   sync.RWMutex
 	options *Options
 	memdb   *memfs.Memtable
-	filter  *boom.ScalableBloomFilter
-	log     *os.File
+	log     *wal.Writer
+	writers []*writer
+	//tables holds the ids of the SSTables from the newest to the oldest, it is guarded by rlock
+	tables  []string
+	//meta holds what is known of each of the tables, it is guarded by rlock and replaced rather than changed
+	meta    map[string]tableMeta
+	cache   *tableCache
+	blocks  *blockCache
+	//sequence is the sequence of the newest SSTable
+	sequence uint64
+	//readers is held shared while SSTables are opened from a list of SSTables taken from tables, so that
+	//compaction does not delete them in between
+	readers sync.RWMutex
+	//compactions wakes up the background compaction, which runs until stopCompaction is closed
+	compactions      chan struct{}
+	stopCompaction   chan struct{}
+	compacting       sync.WaitGroup
+	compactionCount  uint64
+	compactionErrors uint64
+	tombstonesPurged uint64
+	//compactPointers holds the largest key last compacted in each level, it is only used by the compaction
+	compactPointers [maxLevels][]byte
 }
 
 /*
@@ -109,8 +132,12 @@ In order to do so, the client needs to specify the directory where the database
 The client may specify certain options while opening the database.
 The call to open provides an instance of the database back to the client,
 to enable the client to work with the database to store or retrieve data.
-Any C0 component which has not been flushed to disk as a SSTable is loaded
-in memory as a Memtable.
+Any C0 component which has not been flushed to disk as a SSTable is rebuilt
+in memory as a Memtable by replaying the write ahead log. A leftover old log from
+an interrupted rotation is replayed before the current log. Single file SSTables left incomplete
+by a crash are deleted, and so are SSTables which were compacted but left behind.
+Unless the database is read only, its SSTables are compacted in the background once there are
+Options.CompactionTrigger of them, until the database is closed.
  */
 func Open(dir string, options *Options) (db *Database, err error) {
 	if dir == "" {
@@ -119,6 +146,12 @@ func Open(dir string, options *Options) (db *Database, err error) {
 	if options == nil {
 		options = DefaultOptions
 	}
+	if c := options.compression(); c < NoCompression || c > LZ4Compression {
+		return nil, ErrUnknownCompression
+	}
+	if s := options.CompactionStyle; s < SizeTieredCompaction || s > LeveledCompaction {
+		return nil, ErrUnknownCompactionStyle
+	}
 	dir = filepath.Clean(dir)
 	db = newDB(dir, options)
 
@@ -126,25 +159,67 @@ func Open(dir string, options *Options) (db *Database, err error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open database")
 	}
-	_, err = os.Stat(path.Join(db.fs.path, MemdbFileName))
-	if os.IsExist(err) {
-		arr := make([]memfs.Record, 0)
-		memdbFile, err := db.fs.OpenFile(MemdbFileName, os.O_RDONLY, os.ModePerm)
+	//a database which fails to open releases its lock and the SSTables it opened
+	fs, cache := db.fs, db.cache
+	defer func() {
 		if err != nil {
-			return nil, errors.Wrap(err, "failed to load memdb")
+			cache.close()
+			fs.Close()
+		}
+	}()
+	if !options.ReadOnly {
+		if err = db.fs.DeleteTempFiles(); err != nil {
+			return nil, errors.Wrap(err, "failed to open database")
+		}
+	}
+	if err = db.loadTables(); err != nil {
+		return nil, errors.Wrap(err, "failed to open database")
+	}
+	for _, name := range []string{OldLog, CurrentLog} {
+		if err = ReplayLog(db, name); err != nil {
+			return nil, errors.Wrap(err, "failed to recover from write ahead log")
 		}
-		readGob(memdbFile, arr)
-		db.memdb = ArrToMemdb(arr)
 	}
-	db.log, err = db.fs.OpenLogFile(CurrentLog)
+	logFile, err := db.fs.OpenLogFile(CurrentLog)
 	if err != nil {
 		return nil, err
 	}
+	db.log = wal.NewWriter(logFile)
 
+	if db.compactionTrigger() > 0 {
+		db.compactions = make(chan struct{}, 1)
+		db.stopCompaction = make(chan struct{})
+		db.compacting.Add(1)
+		go db.compactLoop(db.stopCompaction)
+		db.scheduleCompaction()
+	}
 	db.open = true
 	return db, nil
 }
 
+/*
+loadTables loads the list of SSTables of the database, from the newest to the oldest, and the sequence of
+the newest. SSTables which were compacted but left behind are deleted, or only left out if the database
+is read only.
+ */
+func (db *Database) loadTables() error {
+	tables, compacted, meta, sequence, err := sortTables(db.cache, GetDataFiles(db.fs.path))
+	if err != nil {
+		return err
+	}
+	for _, id := range compacted {
+		db.cache.evict(id)
+		if db.options.ReadOnly {
+			continue
+		}
+		if err := db.fs.DeleteSSTable(id); err != nil {
+			return err
+		}
+	}
+	db.tables, db.meta, db.sequence = tables, meta, sequence
+	return nil
+}
+
 /*
 Put saves a key and value pair in the database.
 In the event of any issue in saving the key value pair,
@@ -164,68 +239,203 @@ func (db *Database) Put(key, value []byte) (err error) {
 		return ErrValueRequired
 	}
 
+	return db.write(db.options.SyncWrite, wal.Record{
+		Type:  wal.TypePut,
+		Key:   key,
+		Value: value,
+	})
+}
+
+/*
+Write applies all the updates in the batch to the database atomically. Readers either see
+all or none of the updates, and recovery replays all or none of them.
+ */
+func (db *Database) Write(batch *WriteBatch, opts *WriteOptions) (err error) {
+	if !db.open || db.closing {
+		return ErrDatabaseClosed
+	}
+	if db.options.ReadOnly {
+		return ErrDataBaseReadOnly
+	}
+	if batch == nil || batch.Len() == 0 {
+		return nil
+	}
+	if err = batch.validate(); err != nil {
+		return err
+	}
+	syncLog := db.options.SyncWrite
+	if opts != nil {
+		syncLog = syncLog || opts.Sync
+	}
+	records := make([]wal.Record, batch.Len())
+	copy(records, batch.records)
+	return db.write(syncLog, records...)
+}
+
+/*
+maxWriteGroupSize is the number of bytes of keys and values above which the writer at the head of the
+write queue stops adding the writers queued behind it to its group.
+ */
+const maxWriteGroupSize = 1 << 20
+
+/*
+writer is a pending write waiting in the write queue of the database.
+ */
+type writer struct {
+	records []wal.Record
+	size    int
+	sync    bool
+	done    bool
+	err     error
+	cond    *sync.Cond
+}
+
+/*
+write appends the records to the write ahead log and applies them to the memtable.
+The records of a single call are logged as one batch entry.
+Concurrent writers are queued and the writer at the head of the queue commits the records
+of writers queued behind it with a single append to the log and, if any of them asked
+for it, a single sync. A group holds about maxWriteGroupSize bytes at most, the writers left out
+are committed by the next group. Each writer returns once the group containing its records is durable.
+ */
+func (db *Database) write(syncLog bool, records ...wal.Record) (err error) {
+	w := &writer{
+		records: records,
+		sync:    syncLog,
+		cond:    sync.NewCond(&db.lock),
+	}
+	for _, rec := range records {
+		w.size += len(rec.Key) + len(rec.Value)
+	}
 	db.lock.Lock()
 	defer db.lock.Unlock()
-	r := memfs.Record{
-		Key: key,
-		Val: value,
+	db.writers = append(db.writers, w)
+	for !w.done && db.writers[0] != w {
+		w.cond.Wait()
 	}
-	err = WriteLog(db.log, []byte(r.String()))
-	if err != nil {
-		return err
+	if w.done {
+		return w.err
 	}
 
-	if db.options.SyncWrite {
-		err = db.log.Sync()
-		if err != nil {
-			return err
+	err = db.makeRoomForWrite()
+	group := db.writeGroup()
+	if err == nil {
+		err = db.commit(group)
+	}
+	for _, gw := range group {
+		gw.err = err
+		gw.done = true
+		if gw != w {
+			gw.cond.Signal()
 		}
 	}
+	db.writers = db.writers[len(group):]
+	if len(db.writers) > 0 {
+		db.writers[0].cond.Signal()
+	}
+	return err
+}
 
-	if db.memdb.Size() >= filterSize {
-		oldMemdb := db.memdb
-		db.writeKeysToFilter(oldMemdb)
-		err := db.writeSSTable(oldMemdb)
-		if err != nil {
-			return errors.Wrap(err, "failed to write data to sstable")
-		}
-		db.memdb = memfs.NewMemtable()
-		if err = RotateLog(db); err != nil {
-			return errors.Wrap(err, "failed to rotate log file")
+/*
+writeGroup returns the writers at the head of the write queue committed together. The group always
+holds the writer at the head of the queue, whatever the size of its records.
+ */
+func (db *Database) writeGroup() []*writer {
+	size := 0
+	for i, gw := range db.writers {
+		size += gw.size
+		if i > 0 && size > maxWriteGroupSize {
+			return db.writers[:i]
 		}
+	}
+	return db.writers
+}
 
-		if err := db.fs.DeleteFile(MemdbFileName); err != nil {
-			return errors.Wrap(err, "failed to delete memdb file")
+/*
+commit writes the records of a group of writers to the write ahead log and inserts them in the memtable.
+The database lock is released while the log is written, so that other writers can queue up for the next group.
+ */
+func (db *Database) commit(group []*writer) (err error) {
+	entries := make([]wal.Record, 0, len(group))
+	syncLog := false
+	for _, gw := range group {
+		if len(gw.records) == 1 {
+			entries = append(entries, gw.records[0])
+		} else {
+			entries = append(entries, wal.NewBatchRecord(gw.records))
 		}
-
+		syncLog = syncLog || gw.sync
 	}
-	db.memdb.Insert(r)
-
+	db.lock.Unlock()
+	err = db.log.Append(entries...)
+	if err == nil && syncLog {
+		err = db.log.Sync()
+	}
+	db.lock.Lock()
+	if err != nil {
+		return err
+	}
+	db.rlock.Lock()
+	for _, gw := range group {
+		for _, rec := range gw.records {
+			db.memdb.Insert(toMemRecord(rec))
+		}
+	}
+	db.rlock.Unlock()
 	return nil
 }
 
-func (db *Database) writeKeysToFilter(memdb *memfs.Memtable) {
-	sortedRecords := memdb.InOrder()
-	for _, c := range sortedRecords {
-		r, ok := c.(memfs.Record)
-		if ok {
-			db.filter.Add(r.Key)
-		}
+/*
+makeRoomForWrite flushes the memtable to an SSTable and rotates the write ahead log if the memtable is full.
+It runs before the next group is appended to the log, so that rotating the log never discards records
+which are not in the flushed memtable.
+ */
+func (db *Database) makeRoomForWrite() (err error) {
+	if db.memdb.Size() < filterSize {
+		return nil
+	}
+	oldMemdb := db.memdb
+	id, props, err := db.writeSSTable(oldMemdb)
+	if err != nil {
+		return errors.Wrap(err, "failed to write data to sstable")
+	}
+	//readers see either the old memtable or the new SSTable holding its records
+	db.rlock.Lock()
+	db.memdb = memfs.NewMemtable()
+	db.addTable(id, props)
+	db.rlock.Unlock()
+	db.scheduleCompaction()
+	if err = RotateLog(db); err != nil {
+		return errors.Wrap(err, "failed to rotate log file")
 	}
 
+	if err := db.fs.DeleteFile(MemdbFileName); err != nil {
+		return errors.Wrap(err, "failed to delete memdb file")
+	}
+	return nil
 }
 
-func (db *Database) writeSSTable(memdb *memfs.Memtable) (err error) {
+/*
+addTable adds a flushed SSTable, which is the newest, to the SSTables of the database. It must be called with
+rlock held.
+ */
+func (db *Database) addTable(id string, props TableProperties) {
+	meta := make(map[string]tableMeta, len(db.meta)+1)
+	for k, m := range db.meta {
+		meta[k] = m
+	}
+	meta[id] = newTableMeta(props)
+	db.tables = append([]string{id}, db.tables...)
+	db.meta = meta
+}
+
+func (db *Database) writeSSTable(memdb *memfs.Memtable) (id string, props TableProperties, err error) {
 	sst, err := db.fs.NewSSTable()
 	if err != nil {
-		return errors.Wrap(err, "unable to create sstable")
-	}
-	w := NewWriter(sst, db.options.UseCompression)
-	_, err = db.filter.WriteTo(sst.filterfile)
-	defer sst.filterfile.Close()
-	if err != nil {
-		return errors.Wrap(err, "unable to write filter")
+		return "", props, errors.Wrap(err, "unable to create sstable")
 	}
+	w := NewWriterWithOptions(sst, db.options)
+	w.props.Sequence = atomic.AddUint64(&db.sequence, 1)
 	sortedRecords := memdb.InOrder()
 	for _, c := range sortedRecords {
 		r, ok := c.(memfs.Record)
@@ -234,10 +444,9 @@ func (db *Database) writeSSTable(memdb *memfs.Memtable) (err error) {
 		}
 	}
 	if err = w.Close(); err != nil {
-		return errors.Wrap(err, "failed to write records to sstable")
+		return "", props, errors.Wrap(err, "failed to write records to sstable")
 	}
-	db.filter.Reset()
-	return nil
+	return sst.id, w.props, nil
 }
 
 /*
@@ -259,16 +468,45 @@ func (db *Database) Get(key []byte) (value []byte, err error) {
 		}
 		return val, nil
 	}
-	sst, err := db.getSSTWithKey(key)
-	if sst == nil {
-		return nil, ErrKeyNotFound
-	}
-	r := NewReader(sst, db.options.UseCompression)
-	val, ok := r.Get(key)
-	if ok && !bytes.Equal(val, []byte(deleteMarker)) {
+	return db.getFromSSTables(key)
+}
+
+/*
+getFromSSTables looks the key up in the SSTables from the newest to the oldest. Tables whose filter rules
+out the key are skipped, and a table which does not hold the key despite its filter, is a false positive
+after which the search continues with the older tables. The search stops at the newest table holding the
+key, and a tombstone found there hides any older value of the key. Tables whose key range does not hold the
+key are not opened, so with leveled compaction at most one table is read in each level past level 0.
+ */
+func (db *Database) getFromSSTables(key []byte) ([]byte, error) {
+	db.readers.RLock()
+	defer db.readers.RUnlock()
+	tables, meta := db.currentState()
+	for _, id := range tables {
+		if m, ok := meta[id]; ok && !m.mayContain(key) {
+			continue
+		}
+		t, err := db.cache.get(id)
+		if err != nil {
+			return nil, err
+		}
+		if !t.filter.Test(key) {
+			db.cache.release(t)
+			continue
+		}
+		val, err := t.reader.Get(key)
+		db.cache.release(t)
+		if err == ErrKeyNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(val, []byte(deleteMarker)) {
+			return nil, ErrKeyNotFound
+		}
 		return val, nil
 	}
-
 	return nil, ErrKeyNotFound
 }
 
@@ -278,7 +516,9 @@ func (db *Database) findInMemDb(key []byte) []byte {
 		Key: key,
 		Val: nil,
 	}
+	db.rlock.RLock()
 	c := db.memdb.Get(dummy)
+	db.rlock.RUnlock()
 	if c != nil {
 		r, ok := c.(memfs.Record)
 		if ok {
@@ -289,7 +529,8 @@ func (db *Database) findInMemDb(key []byte) []byte {
 }
 
 /*
-Delete deletes the value associated with a key. The value is assigned a special value tombstone\0.
+Delete deletes the value associated with a key. The deletion is logged as a delete record in the write ahead
+log and the key is assigned a special value tombstone\0 in the memtable.
 A deleted key can be resurrected by future writes.
  */
 func (db *Database) Delete(key []byte) (ok bool, err error) {
@@ -300,11 +541,18 @@ func (db *Database) Delete(key []byte) (ok bool, err error) {
 		return false, ErrKeyRequired
 	}
 
+	if db.options.ReadOnly {
+		return false, ErrDeleteFailed
+	}
+
 	_, err = db.Get(key)
 	if err != nil {
 		return false, ErrDeleteFailed
 	}
-	err = db.Put(key, []byte(deleteMarker))
+	err = db.write(db.options.SyncWrite, wal.Record{
+		Type: wal.TypeDelete,
+		Key:  key,
+	})
 	if err != nil {
 		return false, ErrDeleteFailed
 	}
@@ -313,8 +561,9 @@ func (db *Database) Delete(key []byte) (ok bool, err error) {
 
 /*
 Range allows the client to specify a start and an end key and returns a cursor which can be used to iterate
-over the range, start and end key inclusive.
-Range queries work only if the key range specified lies within the same SSTable.
+over the range, start and end key inclusive. The start and end key need not exist in the database.
+The range merges the memtable and every SSTable, returning the most recent value of each key and
+skipping deleted keys. The cursor reads the keys lazily, and must be closed.
  */
 func (db *Database) Range(startkey, endKey []byte) (cursor *Cursor, err error) {
 	if !db.open || db.closing {
@@ -329,63 +578,132 @@ func (db *Database) Range(startkey, endKey []byte) (cursor *Cursor, err error) {
 	if bytes.Compare(startkey, endKey) > 0 {
 		return nil, ErrInvalidRange
 	}
-	sst1, err := db.getSSTWithKey(startkey)
-	if err != nil {
-		return nil, err
-	}
-	sst2, err := db.getSSTWithKey(endKey)
+	iter, err := db.NewIterator(startkey, successor(endKey))
 	if err != nil {
 		return nil, err
 	}
+	return NewCursor(iter), nil
+}
 
-	if strings.Compare(sst1.id, sst2.id) != 0 {
-		return nil, ErrRangeError
+/*
+NewIterator returns an Iterator over the keys from lower, inclusive, to upper, exclusive. A nil bound
+leaves that end of the range open. The iterator merges a snapshot of the memtable with every SSTable,
+returning the most recent value of each key and skipping deleted keys. Keys are read from the SSTables
+a block at a time as the iterator moves. The iterator must be closed to release the SSTables it reads.
+ */
+func (db *Database) NewIterator(lower, upper []byte) (iter Iterator, err error) {
+	if !db.open || db.closing {
+		return nil, ErrDatabaseClosed
 	}
-	r := NewReader(sst1, db.options.UseCompression)
-	cursor, err = r.Range(startkey, endKey)
+	if lower != nil && upper != nil && bytes.Compare(lower, upper) > 0 {
+		return nil, ErrInvalidRange
+	}
+	iters, priorities, release, err := db.rangeIterators(lower, upper)
 	if err != nil {
 		return nil, err
 	}
-	return cursor, nil
+	return newDBIterator(newMergingIterator(iters, priorities), lower, upper, release), nil
+}
 
+/*
+PrefixScan returns an Iterator over all the keys which start with prefix. It shares the merge of the memtable
+and the SSTables with Range, so it returns the most recent value of each key and skips deleted keys.
+ */
+func (db *Database) PrefixScan(prefix []byte) (iter Iterator, err error) {
+	return db.NewIterator(prefix, prefixUpperBound(prefix))
 }
 
-func (db *Database) getSSTWithKey(key []byte) (sstable *SSTable, err error) {
-	files := GetDataFiles(db.fs.path)
-	sort.Sort(ByTime{files, DefaultNameFormat})
-	for _, f := range files {
-		sst, err := db.fs.OpenSSTable(f)
-		if err != nil {
-			return nil, errors.Wrap(err, "failed to open sstables for reading")
+/*
+currentTables returns the ids of the SSTables of the database from the newest to the oldest.
+ */
+func (db *Database) currentTables() []string {
+	db.rlock.RLock()
+	defer db.rlock.RUnlock()
+	return db.tables
+}
+
+/*
+currentState returns the ids of the SSTables of the database from the newest to the oldest, and what is
+known of each of them.
+ */
+func (db *Database) currentState() ([]string, map[string]tableMeta) {
+	db.rlock.RLock()
+	defer db.rlock.RUnlock()
+	return db.tables, db.meta
+}
+
+/*
+rangeIterators returns an iterator over the memtable followed by an iterator over every SSTable,
+from the most recent to the oldest, and the priority of each iterator for merging them. The memtable has the
+highest priority, and the SSTables the priority of their level and sequence. The memtable iterator is over a
+snapshot of the keys from lower to upper. The returned release function must be called once the iterators
+are no longer used, it hands the SSTables back to the table cache.
+ */
+func (db *Database) rangeIterators(lower, upper []byte) ([]Iterator, []uint64, func(), error) {
+	iters := make([]Iterator, 0)
+	priorities := make([]uint64, 0)
+	tables := make([]*cachedTable, 0)
+	release := func() {
+		for _, t := range tables {
+			db.cache.release(t)
 		}
+	}
 
-		db.filter.ReadFrom(sst.filterfile)
-		if !db.filter.Test(key) {
-			db.filter.Reset()
-			sst.filterfile.Close()
-			sst.datafile.Close()
-			sst.metafile.Close()
-			continue
+	var from, to memfs.Comparable
+	if lower != nil {
+		from = memfs.Record{Key: lower}
+	}
+	if upper != nil {
+		to = memfs.Record{Key: upper}
+	}
+	d := make([]data, 0)
+	db.rlock.RLock()
+	records := db.memdb.Range(from, to)
+	db.rlock.RUnlock()
+	for _, c := range records {
+		if r, ok := c.(memfs.Record); ok {
+			d = append(d, data{r.Key, r.Val})
 		}
-		return sst, nil
 	}
-	return nil, ErrKeyNotFound
+	iters = append(iters, newSliceIterator(d))
+	priorities = append(priorities, math.MaxUint64)
+
+	db.readers.RLock()
+	defer db.readers.RUnlock()
+	ids, meta := db.currentState()
+	for _, id := range ids {
+		t, err := db.cache.get(id)
+		if err != nil {
+			release()
+			return nil, nil, nil, errors.Wrap(err, "failed to open sstables for reading")
+		}
+		tables = append(tables, t)
+		iters = append(iters, newTableIterator(t.reader))
+		priorities = append(priorities, tablePriority(meta[id]))
+	}
+	return iters, priorities, release, nil
 }
 
 /*
 Close closes an active database connection and releases any locks acquired on the database.
-It also flushes the C0 component to durable storage.
+It also flushes the C0 component to durable storage by syncing the write ahead log,
+which is replayed by the next call to Open. Closing a database which is already closed does nothing.
  */
 func (db *Database) Close() (ok bool, err error) {
-	memdbFile, err := db.fs.OpenFile(MemdbFileName, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.ModePerm)
-	if err != nil {
-		return false, errors.Wrap(err, "Failed to write memdb to disk")
+	if !db.open {
+		return true, nil
 	}
-	err = writeGob(memdbFile, MemdbToArr(db.memdb))
-	if err != nil {
-		return false, errors.Wrap(err, "failed to flush memdb")
+	if db.stopCompaction != nil {
+		//a compaction in progress is abandoned
+		close(db.stopCompaction)
+		db.compacting.Wait()
+		db.stopCompaction = nil
+	}
+	if err = db.log.Sync(); err != nil {
+		return false, errors.Wrap(err, "failed to sync write ahead log")
 	}
 	db.log.Close()
+	db.cache.close()
 	ok, err = db.fs.Close()
 	if err != nil {
 		return ok, errors.Wrap(err, "failed to close database")
@@ -397,13 +715,15 @@ func (db *Database) Close() (ok bool, err error) {
 func newDB(path string, options *Options) (db *Database) {
 	fs := NewFS(path, options)
 	memdb := memfs.NewMemtable()
+	blocks := newBlockCache(options.BlockCacheSize)
 	db = &Database{
 		fs:      fs,
 		options: options,
 		open:    true,
 		closing: false,
 		memdb:   memdb,
-		filter:  boom.NewDefaultScalableBloomFilter(0.0001),
+		cache:   newTableCache(fs, options, blocks),
+		blocks:  blocks,
 	}
 	return db
 
@@ -0,0 +1,192 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package gokvstore
+
+import "bytes"
+
+/*
+dbIterator is the Iterator handed out by the database. It wraps the merge of the memtable and the
+SSTables, restricting it to the keys between the lower bound, inclusive, and the upper bound, exclusive,
+and skipping deleted keys. It holds on to the SSTables it reads from until it is closed.
+ */
+type dbIterator struct {
+	iter         Iterator
+	lower, upper []byte
+	release      func()
+	valid        bool
+	started      bool
+}
+
+/*
+First moves the iterator to the first key within the bounds.
+ */
+func (it *dbIterator) First() bool {
+	it.started = true
+	if it.lower != nil {
+		it.valid = it.iter.Seek(it.lower)
+	} else {
+		it.valid = it.iter.First()
+	}
+	return it.skipForward()
+}
+
+/*
+Last moves the iterator to the last key within the bounds.
+ */
+func (it *dbIterator) Last() bool {
+	it.started = true
+	if it.upper != nil && it.iter.Seek(it.upper) {
+		it.valid = it.iter.Prev()
+	} else {
+		it.valid = it.iter.Last()
+	}
+	return it.skipBackward()
+}
+
+/*
+Seek moves the iterator to the first key within the bounds which is greater than or equal to key.
+ */
+func (it *dbIterator) Seek(key []byte) bool {
+	it.started = true
+	if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+		key = it.lower
+	}
+	it.valid = it.iter.Seek(key)
+	return it.skipForward()
+}
+
+/*
+SeekForPrev moves the iterator to the last key within the bounds which is less than or equal to key.
+ */
+func (it *dbIterator) SeekForPrev(key []byte) bool {
+	if it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+		return it.Last()
+	}
+	it.started = true
+	it.valid = it.iter.SeekForPrev(key)
+	return it.skipBackward()
+}
+
+/*
+Next moves the iterator to the next key.
+ */
+func (it *dbIterator) Next() bool {
+	if !it.started {
+		return it.First()
+	}
+	it.valid = it.iter.Next()
+	return it.skipForward()
+}
+
+/*
+Prev moves the iterator to the previous key.
+ */
+func (it *dbIterator) Prev() bool {
+	if !it.started {
+		return it.Last()
+	}
+	it.valid = it.iter.Prev()
+	return it.skipBackward()
+}
+
+/*
+skipForward moves the iterator forward past tombstones, and past keys below the lower bound which it may be
+positioned at after moving backward out of the bounds. It stops at the upper bound.
+ */
+func (it *dbIterator) skipForward() bool {
+	for it.valid {
+		key := it.iter.Key()
+		if it.upper != nil && bytes.Compare(key, it.upper) >= 0 {
+			it.valid = false
+			break
+		}
+		if (it.lower == nil || bytes.Compare(key, it.lower) >= 0) && !isTombstone(it.iter.Value()) {
+			break
+		}
+		it.valid = it.iter.Next()
+	}
+	return it.valid
+}
+
+/*
+skipBackward moves the iterator backward past tombstones, and past keys at or above the upper bound which it
+may be positioned at after moving forward out of the bounds. It stops at the lower bound.
+ */
+func (it *dbIterator) skipBackward() bool {
+	for it.valid {
+		key := it.iter.Key()
+		if it.lower != nil && bytes.Compare(key, it.lower) < 0 {
+			it.valid = false
+			break
+		}
+		if (it.upper == nil || bytes.Compare(key, it.upper) < 0) && !isTombstone(it.iter.Value()) {
+			break
+		}
+		it.valid = it.iter.Prev()
+	}
+	return it.valid
+}
+
+/*
+Key returns the current key.
+ */
+func (it *dbIterator) Key() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.iter.Key()
+}
+
+/*
+Value returns the value of the current key.
+ */
+func (it *dbIterator) Value() []byte {
+	if !it.valid {
+		return nil
+	}
+	return it.iter.Value()
+}
+
+/*
+Error returns any error encountered while reading the memtable or the SSTables.
+ */
+func (it *dbIterator) Error() error {
+	return it.iter.Error()
+}
+
+/*
+Close closes the merged iterators and releases the SSTables.
+ */
+func (it *dbIterator) Close() error {
+	it.valid = false
+	err := it.iter.Close()
+	if it.release != nil {
+		it.release()
+		it.release = nil
+	}
+	return err
+}
+
+func newDBIterator(iter Iterator, lower, upper []byte, release func()) *dbIterator {
+	return &dbIterator{
+		iter:    iter,
+		lower:   lower,
+		upper:   upper,
+		release: release,
+	}
+}
+
+func isTombstone(value []byte) bool {
+	return bytes.Equal(value, []byte(deleteMarker))
+}
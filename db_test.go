@@ -13,10 +13,25 @@
 package gokvstore
 
 import (
+	"bufio"
 	"bytes"
+	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/maneeshchaturvedi/gokvstore/memfs"
+	"github.com/maneeshchaturvedi/gokvstore/wal"
+	"github.com/pkg/errors"
 )
 
 func TestDatabase_Open_EmptyDir(t *testing.T) {
@@ -380,24 +395,303 @@ func TestDatabaseRange(t *testing.T) {
 	if err != nil {
 		t.Error("failed to open database", err)
 	}
+	for _, k := range []string{"02j5C", "03abc", "04ZfI"} {
+		if err := db.Put([]byte(k), []byte(k)); err != nil {
+			t.Error("Put failed", err)
+		}
+	}
 	cur, err := db.Range([]byte("02j5C"), []byte("04ZfI"))
-	if cur == nil && err != ErrKeyNotFound {
-		t.Errorf("expexted %s, got %s", ErrKeyNotFound, err)
+	if err != nil {
+		t.Fatal("Range failed", err)
+	}
+	keys := make([][]byte, 0)
+	for cur.Next() {
+		keys = append(keys, append([]byte(nil), cur.Key()...))
+	}
+	if len(keys) < 3 {
+		t.Fatalf("expected at least 3 keys, got %d", len(keys))
+	}
+	if !bytes.Equal(keys[0], []byte("02j5C")) {
+		t.Errorf("expected %s, got %s", []byte("02j5C"), keys[0])
+	}
+	if !bytes.Equal(keys[len(keys)-1], []byte("04ZfI")) {
+		t.Errorf("expected %s, got %s", []byte("04ZfI"), keys[len(keys)-1])
+	}
+	cur.Close()
+	db.Close()
+}
+
+func TestDatabaseRange_AcrossTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
 	}
-	if cur == nil {
-		return
+	defer os.RemoveAll(dir)
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	writeTestTable(t, db, map[string]string{
+		"a1": "old", "a2": "old", "a3": "old", "a4": "old", "a5": "old", "b1": "old", "c1": "old",
+	})
+	writeTestTable(t, db, map[string]string{
+		"a3": "new", "a4": deleteMarker, "a6": "new",
+	})
+	db.Put([]byte("a5"), []byte("mem"))
+	db.Put([]byte("b2"), []byte("mem"))
+	db.Delete([]byte("a6"))
+
+	cur, err := db.Range([]byte("a0"), []byte("b9"))
+	if err != nil {
+		t.Fatal("Range failed", err)
 	}
+	defer cur.Close()
+	expected := []string{"a1=old", "a2=old", "a3=new", "a5=mem", "b1=old", "b2=mem"}
+	got := make([]string, 0)
 	for cur.Next() {
-		if !bytes.Equal(cur.data[1].key, []byte("02j5C")) {
-			t.Errorf("expected %s, got %s", []byte("02j5C"), cur.data[1].key)
+		got = append(got, fmt.Sprintf("%s=%s", cur.Key(), cur.Value()))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestDatabase_NewIterator(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	old := make(map[string]string)
+	for j := 0; j < 2000; j++ {
+		old[fmt.Sprintf("key%04d", j)] = "old"
+	}
+	writeTestTable(t, db, old)
+	writeTestTable(t, db, map[string]string{"key0500": "new", "key0501": deleteMarker})
+	db.Put([]byte("key0502"), []byte("mem"))
+
+	iter, err := db.NewIterator([]byte("key0100"), []byte("key1900"))
+	if err != nil {
+		t.Fatal("NewIterator failed", err)
+	}
+	defer iter.Close()
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	if n != 1799 {
+		t.Errorf("expected 1799 keys, got %d", n)
+	}
+	if !iter.First() || string(iter.Key()) != "key0100" {
+		t.Errorf("expected first key key0100, got %s", iter.Key())
+	}
+	if !iter.Last() || string(iter.Key()) != "key1899" {
+		t.Errorf("expected last key key1899, got %s", iter.Key())
+	}
+	if !iter.Seek([]byte("key0500")) || string(iter.Value()) != "new" {
+		t.Errorf("expected new, got %s", iter.Value())
+	}
+	if !iter.Next() || string(iter.Key()) != "key0502" || string(iter.Value()) != "mem" {
+		t.Errorf("expected key0502=mem, got %s=%s", iter.Key(), iter.Value())
+	}
+	if !iter.Prev() || string(iter.Key()) != "key0500" {
+		t.Errorf("expected key0500, got %s", iter.Key())
+	}
+	if !iter.Prev() || string(iter.Key()) != "key0499" {
+		t.Errorf("expected key0499, got %s", iter.Key())
+	}
+	n = 1
+	for iter.Prev() {
+		n++
+	}
+	if n != 400 {
+		t.Errorf("expected 400 keys before key0500, got %d", n)
+	}
+	if err := iter.Error(); err != nil {
+		t.Error("iterator failed", err)
+	}
+}
+
+func TestDatabase_IteratorBounds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true, CompactionTrigger: -1})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	writeTestTable(t, db, map[string]string{"a": "1", "b": "1", "c": "1", "d": "1", "e": "1", "f": "1"})
+	//tombstones past the bounds
+	writeTestTable(t, db, map[string]string{"a0": deleteMarker, "d0": deleteMarker, "e": deleteMarker})
+
+	iter, err := db.NewIterator([]byte("b"), []byte("d"))
+	if err != nil {
+		t.Fatal("NewIterator failed", err)
+	}
+	defer iter.Close()
+	for iter.Next() {
+	}
+	//moving on past the upper bound and back returns the last key within the bounds
+	if iter.Next() {
+		t.Errorf("expected no key past the upper bound, got %s", iter.Key())
+	}
+	if !iter.Prev() || string(iter.Key()) != "c" {
+		t.Errorf("expected c, got %s", iter.Key())
+	}
+	for iter.Prev() {
+	}
+	if iter.Prev() {
+		t.Errorf("expected no key before the lower bound, got %s", iter.Key())
+	}
+	if !iter.Next() || string(iter.Key()) != "b" {
+		t.Errorf("expected b, got %s", iter.Key())
+	}
+	if iter.Seek([]byte("d")) {
+		t.Errorf("expected no key from the upper bound, got %s", iter.Key())
+	}
+	if !iter.Prev() || string(iter.Key()) != "c" {
+		t.Errorf("expected c, got %s", iter.Key())
+	}
+}
+
+func TestDatabase_ReverseIteration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	old := make(map[string]string)
+	for j := 0; j < 2000; j += 2 {
+		old[fmt.Sprintf("key%04d", j)] = "old"
+	}
+	writeTestTable(t, db, old)
+	db.Put([]byte("key1001"), []byte("mem"))
+	db.Delete([]byte("key0998"))
+
+	iter, err := db.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal("NewIterator failed", err)
+	}
+	defer iter.Close()
+	page := make([]string, 0)
+	for ok := iter.SeekForPrev([]byte("key1003")); ok && len(page) < 4; ok = iter.Prev() {
+		page = append(page, string(iter.Key()))
+	}
+	expected := []string{"key1002", "key1001", "key1000", "key0996"}
+	if fmt.Sprint(page) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, page)
+	}
+
+	cur, err := db.Range([]byte("key0100"), []byte("key0110"))
+	if err != nil {
+		t.Fatal("Range failed", err)
+	}
+	defer cur.Close()
+	keys := make([]string, 0)
+	for cur.Prev() {
+		keys = append(keys, string(cur.Key()))
+	}
+	expected = []string{"key0110", "key0108", "key0106", "key0104", "key0102", "key0100"}
+	if fmt.Sprint(keys) != fmt.Sprint(expected) {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+}
+
+func TestDatabase_PrefixScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	writeTestTable(t, db, map[string]string{
+		"user/1": "v", "user/1/a": "v", "user/1/b": "v", "user/10": "v", "user/2/a": "v",
+		"a\xff": "v", "a\xff\x00": "v", "a\xff\xff\x01": "v", "b": "v", "\xff\xff": "v",
+	})
+	db.Put([]byte("user/1/c"), []byte("mem"))
+	db.Delete([]byte("user/1/b"))
+
+	tests := []struct {
+		prefix   string
+		expected []string
+	}{
+		{"user/1/", []string{"user/1/a", "user/1/c"}},
+		{"user/1", []string{"user/1", "user/1/a", "user/1/c", "user/10"}},
+		{"a\xff", []string{"a\xff", "a\xff\x00", "a\xff\xff\x01"}},
+		{"\xff", []string{"\xff\xff"}},
+		{"c", []string{}},
+	}
+	for _, test := range tests {
+		iter, err := db.PrefixScan([]byte(test.prefix))
+		if err != nil {
+			t.Fatal("PrefixScan failed", err)
 		}
-		if !bytes.Equal(cur.data[len(cur.data)-1].key, []byte("04ZfI")) {
-			t.Errorf("expected %s, got %s", []byte("04ZfI"), cur.data[len(cur.data)-1].key)
+		keys := make([]string, 0)
+		for iter.Next() {
+			keys = append(keys, string(iter.Key()))
 		}
+		iter.Close()
+		if fmt.Sprintf("%q", keys) != fmt.Sprintf("%q", test.expected) {
+			t.Errorf("prefix %q: expected %q, got %q", test.prefix, test.expected, keys)
+		}
+	}
+}
 
+/*
+writeTestTable flushes the records to a new SSTable of the database, which is newer than
+the SSTables written before it.
+ */
+func writeTestTable(t testing.TB, db *Database, records map[string]string) {
+	memdb := memfs.NewMemtable()
+	for k, v := range records {
+		memdb.Insert(memfs.Record{Key: []byte(k), Val: []byte(v)})
 	}
-	cur.Close()
-	db.Close()
+	time.Sleep(2 * time.Millisecond)
+	id, props, err := db.writeSSTable(memdb)
+	if err != nil {
+		t.Fatal("failed to write sstable", err)
+	}
+	db.rlock.Lock()
+	db.addTable(id, props)
+	db.rlock.Unlock()
 }
 
 func TestDatabaseGet(t *testing.T) {
@@ -539,69 +833,1477 @@ func TestDatabase_GetFromSStable(t *testing.T) {
 
 }
 
-func BenchmarkDatabase_Put(b *testing.B) {
-	dir := "/tmp/test"
-	opts := Options{
-		ReadOnly:       false,
-		UseCompression: true,
-		SyncWrite:      false,
+func TestDatabase_TableFilters(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
 	}
-	db, err := Open(dir, &opts)
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true})
 	if err != nil {
-		b.Error("failed to open database", err)
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	tables := []map[string]string{make(map[string]string), make(map[string]string)}
+	for j := 0; j < 2000; j++ {
+		tables[j%2][fmt.Sprintf("key%04d", j)] = fmt.Sprintf("value%04d", j)
+	}
+	for _, records := range tables {
+		writeTestTable(t, db, records)
 	}
 
-	for j := 0; j < b.N; j++ {
-		err := db.Put(randomBytes(5), randomBytes(5))
+	files := GetDataFiles(dir)
+	sort.Sort(ByTime{files, DefaultNameFormat})
+	//the newest table holds the odd keys, its filter must not contain the keys of the older table
+	table, err := db.cache.get(files[0])
+	if err != nil {
+		t.Fatal("failed to open sstable", err)
+	}
+	defer db.cache.release(table)
+	filter := table.filter
+	falsePositives := 0
+	for k := range tables[0] {
+		if filter.Test([]byte(k)) {
+			falsePositives++
+		}
+	}
+	for k := range tables[1] {
+		if !filter.Test([]byte(k)) {
+			t.Fatalf("filter of %s is missing %s", files[0], k)
+		}
+	}
+	if falsePositives > 10 {
+		t.Errorf("filter of %s matched %d keys of another table", files[0], falsePositives)
+	}
+	for _, records := range tables {
+		for k, v := range records {
+			val, err := db.Get([]byte(k))
+			if err != nil || string(val) != v {
+				t.Fatalf("expected %s, got %s, %v", v, val, err)
+			}
+		}
+	}
+}
+
+/*
+forceFilterHit adds the keys to the cached filter of every SSTable, so that Get has to read every table
+to find out whether it holds them.
+ */
+func forceFilterHit(t *testing.T, db *Database, keys ...string) {
+	for _, id := range db.currentTables() {
+		table, err := db.cache.get(id)
 		if err != nil {
-			b.Error("failed to put", err)
+			t.Fatal("failed to open sstable", err)
 		}
+		for _, k := range keys {
+			table.filter.Add([]byte(k))
+		}
+		db.cache.release(table)
 	}
-	db.Close()
+}
+
+func TestDatabaseGet_FilterFalsePositive(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	writeTestTable(t, db, map[string]string{"a": "oldest", "b": "oldest", "c": "oldest", "d": "oldest"})
+	writeTestTable(t, db, map[string]string{"b": "middle", "c": deleteMarker})
+	writeTestTable(t, db, map[string]string{"x": "newest", "d": "newest"})
+	forceFilterHit(t, db, "a", "b", "c", "d", "e")
 
+	tests := []struct {
+		key   string
+		value string
+		err   error
+	}{
+		{"a", "oldest", nil},
+		{"b", "middle", nil},
+		{"c", "", ErrKeyNotFound},
+		{"d", "newest", nil},
+		{"e", "", ErrKeyNotFound},
+	}
+	for _, tt := range tests {
+		val, err := db.Get([]byte(tt.key))
+		if err != tt.err || string(val) != tt.value {
+			t.Errorf("Get(%s): expected %q, %v, got %q, %v", tt.key, tt.value, tt.err, val, err)
+		}
+	}
 }
 
-func BenchmarkDatabase_Get(b *testing.B) {
-	dir := "/tmp/test"
-	opts := Options{
-		ReadOnly:       false,
-		UseCompression: true,
-		SyncWrite:      false,
+func TestDatabaseGet_TombstoneHidesOlderValues(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
 	}
-	db, err := Open(dir, &opts)
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true})
 	if err != nil {
-		b.Error("failed to open database", err)
+		t.Fatal("failed to open database", err)
 	}
-	testKeys := make([][]byte, 0)
-	for j := 0; j < 2.5*filterSize; j++ {
-		k := randomBytes(5)
-		testKeys = append(testKeys, k)
-		db.Put(k, randomBytes(5))
+	defer db.Close()
+	writeTestTable(t, db, map[string]string{"key": "old"})
+	writeTestTable(t, db, map[string]string{"key": deleteMarker})
+	if _, err := db.Get([]byte("key")); err != ErrKeyNotFound {
+		t.Errorf("expected %v, got %v", ErrKeyNotFound, err)
 	}
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		_, err := db.Get(testKeys[i%len(testKeys)])
-		if err != nil {
-			b.Error("failed to get", err)
+	writeTestTable(t, db, map[string]string{"key": "new"})
+	forceFilterHit(t, db, "key")
+	val, err := db.Get([]byte("key"))
+	if err != nil || string(val) != "new" {
+		t.Errorf("expected new, got %s, %v", val, err)
+	}
+}
+
+/*
+openFiles returns the number of SSTable data files in dir which are open by the process.
+ */
+func openFiles(t *testing.T, dir string) int {
+	fds, err := ioutil.ReadDir("/proc/self/fd")
+	if err != nil {
+		t.Skip("cannot list open files", err)
+	}
+	n := 0
+	for _, fd := range fds {
+		name, err := os.Readlink(filepath.Join("/proc/self/fd", fd.Name()))
+		if err == nil && filepath.Dir(name) == dir && filepath.Ext(name) == dataFileExt {
+			n++
 		}
 	}
-	db.Close()
+	return n
+}
 
+/*
+mappedFiles returns the number of mappings of files in dir held by the process.
+ */
+func mappedFiles(t *testing.T, dir string) int {
+	maps, err := ioutil.ReadFile("/proc/self/maps")
+	if err != nil {
+		t.Skip("cannot list mapped files", err)
+	}
+	return strings.Count(string(maps), dir+"/")
 }
 
-const charset = "abcdefghijklmnopqrstuvwxyz" +
-	"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+func TestDatabase_TableCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true, MaxOpenFiles: reservedOpenFiles + 2})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	for i := 0; i < 6; i++ {
+		writeTestTable(t, db, map[string]string{fmt.Sprintf("key%d", i): fmt.Sprintf("value%d", i)})
+	}
 
-var seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	if n := openFiles(t, dir); n != 0 {
+		t.Errorf("expected no open tables, got %d", n)
+	}
+	for round := 0; round < 3; round++ {
+		for i := 0; i < 6; i++ {
+			val, err := db.Get([]byte(fmt.Sprintf("key%d", i)))
+			if err != nil || string(val) != fmt.Sprintf("value%d", i) {
+				t.Fatalf("expected value%d, got %s, %v", i, val, err)
+			}
+		}
+	}
+	if db.cache.lru.Len() != 2 {
+		t.Errorf("expected 2 cached tables, got %d", db.cache.lru.Len())
+	}
+	if n := openFiles(t, dir); n != 2 {
+		t.Errorf("expected 2 open tables, got %d", n)
+	}
 
-func bytesWithCharset(length int, charset string) []byte {
-	b := make([]byte, length)
-	for i := range b {
-		b[i] = charset[seededRand.Intn(len(charset))]
+	//an iterator keeps every table open until it is closed, even those evicted from the cache
+	iter, err := db.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal("NewIterator failed", err)
+	}
+	n := 0
+	for iter.Next() {
+		n++
+	}
+	if n != 6 {
+		t.Errorf("expected 6 keys, got %d", n)
+	}
+	if n := openFiles(t, dir); n != 6 {
+		t.Errorf("expected 6 open tables while iterating, got %d", n)
+	}
+	if err := iter.Close(); err != nil {
+		t.Error("failed to close iterator", err)
+	}
+	if n := openFiles(t, dir); n != 2 {
+		t.Errorf("expected 2 open tables after iterating, got %d", n)
 	}
-	return b
 }
 
-func randomBytes(length int) []byte {
-	return bytesWithCharset(length, charset)
+func TestDatabase_BlockCacheStats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	records := make(map[string]string)
+	for j := 0; j < 1000; j++ {
+		records[fmt.Sprintf("key%04d", j)] = fmt.Sprintf("value%04d", j)
+	}
+	writeTestTable(t, db, records)
+
+	val, err := db.Get([]byte("key0500"))
+	if err != nil {
+		t.Fatal("Get failed", err)
+	}
+	stats := db.Stats()
+	if stats.BlockCacheMisses == 0 || stats.BlockCacheSize == 0 {
+		t.Errorf("expected the first Get to read blocks into the cache, got %+v", stats)
+	}
+	//the value handed out is a copy, changing it must not change the cached block
+	copy(val, "changed")
+	val, err = db.Get([]byte("key0500"))
+	if err != nil || string(val) != "value0500" {
+		t.Errorf("expected value0500, got %s, %v", val, err)
+	}
+	again := db.Stats()
+	if again.BlockCacheMisses != stats.BlockCacheMisses || again.BlockCacheHits <= stats.BlockCacheHits {
+		t.Errorf("expected the second Get to be served from the cache, got %+v after %+v", again, stats)
+	}
+}
+
+func TestDatabase_BlockCacheDisabled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true, BlockCacheSize: -1})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	writeTestTable(t, db, map[string]string{"key": "value"})
+	for i := 0; i < 2; i++ {
+		if val, err := db.Get([]byte("key")); err != nil || string(val) != "value" {
+			t.Errorf("expected value, got %s, %v", val, err)
+		}
+	}
+	if stats := db.Stats(); stats != (Stats{}) {
+		t.Errorf("expected no block cache stats, got %+v", stats)
+	}
+}
+
+func TestDatabase_CloseReleasesTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true, MaxOpenFiles: reservedOpenFiles + 3})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	for i := 0; i < 5; i++ {
+		writeTestTable(t, db, map[string]string{fmt.Sprintf("key%d", i): fmt.Sprintf("value%d", i)})
+	}
+	for j := 0; j < 200; j++ {
+		key := fmt.Sprintf("key%d", j%6)
+		if _, err := db.Get([]byte(key)); err != nil && err != ErrKeyNotFound {
+			t.Fatal("Get failed", err)
+		}
+	}
+	if n := mappedFiles(t, dir); n != 3 {
+		t.Errorf("expected 3 mapped tables, got %d", n)
+	}
+	db.Close()
+	if n := openFiles(t, dir); n != 0 {
+		t.Errorf("expected no open tables after Close, got %d", n)
+	}
+	if n := mappedFiles(t, dir); n != 0 {
+		t.Errorf("expected no mapped tables after Close, got %d", n)
+	}
+}
+
+func TestDatabase_RecoverFromLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	for j := 0; j < 100; j++ {
+		err := db.Put([]byte(fmt.Sprintf("key%03d", j)), []byte(fmt.Sprintf("value%03d", j)))
+		if err != nil {
+			t.Error("failed to put", err)
+		}
+	}
+	if err := db.Put([]byte("a:b;c"), []byte("d;e:f")); err != nil {
+		t.Error("failed to put", err)
+	}
+	if _, err := db.Delete([]byte("key000")); err != nil {
+		t.Error("failed to delete", err)
+	}
+	db.Close()
+
+	db, err = Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to reopen database", err)
+	}
+	defer db.Close()
+	if _, err := db.Get([]byte("key000")); err != ErrKeyNotFound {
+		t.Errorf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+	val, err := db.Get([]byte("a:b;c"))
+	if err != nil || !bytes.Equal(val, []byte("d;e:f")) {
+		t.Errorf("expected %s, got %s, %v", "d;e:f", val, err)
+	}
+	for j := 1; j < 100; j++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key%03d", j)))
+		if err != nil {
+			t.Error("Get failed", err)
+		}
+		if !bytes.Equal(val, []byte(fmt.Sprintf("value%03d", j))) {
+			t.Errorf("expected %s, got %s", fmt.Sprintf("value%03d", j), val)
+		}
+	}
+}
+
+func TestDatabase_Write(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	if err := db.Put([]byte("key1"), []byte("value1")); err != nil {
+		t.Error("failed to put", err)
+	}
+	batch := new(WriteBatch)
+	batch.Put([]byte("key2"), []byte("value2"))
+	batch.Put([]byte("key3"), []byte("value3"))
+	batch.Delete([]byte("key1"))
+	if batch.Len() != 3 {
+		t.Errorf("expected 3 updates, got %d", batch.Len())
+	}
+	if err := db.Write(batch, &WriteOptions{Sync: true}); err != nil {
+		t.Fatal("failed to write batch", err)
+	}
+	if _, err := db.Get([]byte("key1")); err != ErrKeyNotFound {
+		t.Errorf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+	for _, k := range []string{"key2", "key3"} {
+		if _, err := db.Get([]byte(k)); err != nil {
+			t.Errorf("Get %s failed %v", k, err)
+		}
+	}
+
+	batch.Clear()
+	batch.Put([]byte("key4"), nil)
+	if err := db.Write(batch, nil); err != ErrValueRequired {
+		t.Errorf("expected %v, got %v", ErrValueRequired, err)
+	}
+	db.Close()
+}
+
+func TestDatabase_WriteRecoverAllOrNothing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	if err := db.Put([]byte("key0"), []byte("value0")); err != nil {
+		t.Error("failed to put", err)
+	}
+	batch := new(WriteBatch)
+	for j := 1; j < 10; j++ {
+		batch.Put([]byte(fmt.Sprintf("key%d", j)), []byte(fmt.Sprintf("value%d", j)))
+	}
+	if err := db.Write(batch, nil); err != nil {
+		t.Fatal("failed to write batch", err)
+	}
+	db.Close()
+
+	logFile := filepath.Join(dir, CurrentLog)
+	stat, err := os.Stat(logFile)
+	if err != nil {
+		t.Fatal("failed to stat log", err)
+	}
+	os.Truncate(logFile, stat.Size()-5)
+
+	db, err = Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to reopen database", err)
+	}
+	defer db.Close()
+	if _, err := db.Get([]byte("key0")); err != nil {
+		t.Error("Get failed", err)
+	}
+	for j := 1; j < 10; j++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("key%d", j))); err != ErrKeyNotFound {
+			t.Errorf("key%d from a torn batch should not be recovered, got %v", j, err)
+		}
+	}
+}
+
+func TestDatabase_CloseTwice(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Fatal("failed to put", err)
+	}
+	for j := 0; j < 2; j++ {
+		if ok, err := db.Close(); !ok || err != nil {
+			t.Errorf("close %d: expected the database to close, got %v and %v", j, ok, err)
+		}
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != ErrDatabaseClosed {
+		t.Errorf("expected %v, got %v", ErrDatabaseClosed, err)
+	}
+}
+
+func TestDatabase_OpenLegacyTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	//the SSTable in test_data was written before SSTables had a footer
+	files, err := filepath.Glob("test_data/*")
+	if err != nil || len(files) != 3 {
+		t.Fatalf("expected the three files of an SSTable in test_data, got %v and %v", files, err)
+	}
+	for _, name := range files {
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatal("failed to read file", err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, filepath.Base(name)), data, os.ModePerm); err != nil {
+			t.Fatal("failed to copy file", err)
+		}
+	}
+	meta, err := ioutil.ReadFile(files[0][:len(files[0])-len(filepath.Ext(files[0]))] + metaFileExt)
+	if err != nil {
+		t.Fatal("failed to read meta file", err)
+	}
+	lm, err := decodeLegacyMeta(meta)
+	if err != nil {
+		t.Fatal("failed to decode meta file", err)
+	}
+
+	opts := Options{UseCompression: true}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	iter, err := db.NewIterator(nil, nil)
+	if err != nil {
+		t.Fatal("failed to create iterator", err)
+	}
+	n := 0
+	for ; iter.Next(); n++ {
+		if n >= len(lm.keys) || !bytes.Equal(iter.Key(), lm.keys[n].Key) {
+			t.Fatalf("unexpected key %s at %d", iter.Key(), n)
+		}
+		if n%1000 == 0 {
+			if val, err := db.Get(iter.Key()); err != nil || !bytes.Equal(val, iter.Value()) {
+				t.Errorf("expected %s for %s, got %s and %v", iter.Value(), iter.Key(), val, err)
+			}
+		}
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal("failed to iterate", err)
+	}
+	if n != len(lm.keys) {
+		t.Errorf("expected %d keys, got %d", len(lm.keys), n)
+	}
+	if _, err := db.Get([]byte("missing")); err != ErrKeyNotFound {
+		t.Errorf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+	if err := db.Put([]byte("key"), []byte("value")); err != nil {
+		t.Error("failed to put", err)
+	}
+	db.Close()
+
+	db, err = Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to reopen database", err)
+	}
+	defer db.Close()
+	for _, key := range [][]byte{lm.keys[0].Key, lm.keys[len(lm.keys)-1].Key, []byte("key")} {
+		if _, err := db.Get(key); err != nil {
+			t.Errorf("Get %s failed %v", key, err)
+		}
+	}
+}
+
+func TestCompactor_DatabaseOpen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{UseCompression: true, CompactionTrigger: -1}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	for j := 0; j < 4; j++ {
+		writeTestTable(t, db, map[string]string{fmt.Sprintf("key%d", j): "value"})
+	}
+	tables := len(GetDataFiles(dir))
+	if err := NewCompactor(dir).Compact(); err != ErrDatabaseInUse {
+		t.Errorf("expected %v, got %v", ErrDatabaseInUse, err)
+	}
+	if files := GetDataFiles(dir); len(files) != tables {
+		t.Errorf("expected the %d sstables of the open database to be left, got %d", tables, len(files))
+	}
+	db.Close()
+
+	if err := NewCompactor(dir).Compact(); err != nil {
+		t.Fatal("failed to compact", err)
+	}
+	if files := GetDataFiles(dir); len(files) != 1 {
+		t.Errorf("expected a single sstable after compaction, got %d", len(files))
+	}
+	//the lock is released once the compaction is done
+	db, err = Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to reopen database", err)
+	}
+	defer db.Close()
+	for j := 0; j < 4; j++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("key%d", j))); err != nil {
+			t.Errorf("Get key%d failed %v", j, err)
+		}
+	}
+}
+
+func TestDatabase_GroupCommit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	//every writer mixes single puts, batches and synced writes, and records the keys it was acknowledged for
+	acked := make([][]string, 16)
+	var wg sync.WaitGroup
+	for g := range acked {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				key := fmt.Sprintf("key%02d-%03d", g, j)
+				if j%2 == 0 {
+					if err := db.Put([]byte(key), []byte("value-"+key)); err != nil {
+						t.Error("failed to put", err)
+						return
+					}
+					acked[g] = append(acked[g], key)
+					continue
+				}
+				batch := new(WriteBatch)
+				batch.Put([]byte(key+"a"), []byte("value-"+key+"a"))
+				batch.Put([]byte(key+"b"), []byte("value-"+key+"b"))
+				if err := db.Write(batch, &WriteOptions{Sync: j%5 == 0}); err != nil {
+					t.Error("failed to write batch", err)
+					return
+				}
+				acked[g] = append(acked[g], key+"a", key+"b")
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	check := func(db *Database) {
+		for _, keys := range acked {
+			for _, key := range keys {
+				val, err := db.Get([]byte(key))
+				if err != nil || string(val) != "value-"+key {
+					t.Fatalf("expected %s for %s, got %s and %v", "value-"+key, key, val, err)
+				}
+			}
+		}
+	}
+	check(db)
+	db.Close()
+	db, err = Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to reopen database", err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestDatabase_GroupCommitError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	//appending to a log opened for reading fails
+	readOnlyLog, err := os.Open(filepath.Join(dir, CurrentLog))
+	if err != nil {
+		t.Fatal("failed to open log", err)
+	}
+	defer readOnlyLog.Close()
+	log := db.log
+	db.log = wal.NewWriter(readOnlyLog)
+	defer func() { db.log = log }()
+
+	//a writer at the head of the queue holds back the others until all of them are queued
+	db.lock.Lock()
+	head := &writer{cond: sync.NewCond(&db.lock)}
+	db.writers = append(db.writers, head)
+	db.lock.Unlock()
+	const n = 8
+	errs := make(chan error, n)
+	for j := 0; j < n; j++ {
+		go func(j int) {
+			errs <- db.Put([]byte(fmt.Sprintf("key%d", j)), []byte("value"))
+		}(j)
+	}
+	for queued := 0; queued < n+1; {
+		time.Sleep(time.Millisecond)
+		db.lock.Lock()
+		queued = len(db.writers)
+		db.lock.Unlock()
+	}
+	db.lock.Lock()
+	db.writers = db.writers[1:]
+	db.writers[0].cond.Signal()
+	db.lock.Unlock()
+
+	//the writers are committed as one group, so each of them gets the error of the single append
+	first := <-errs
+	if first == nil {
+		t.Fatal("expected the append to the log to fail")
+	}
+	for j := 1; j < n; j++ {
+		if err := <-errs; err != first {
+			t.Errorf("expected %v, got %v", first, err)
+		}
+	}
+	for j := 0; j < n; j++ {
+		if _, err := db.Get([]byte(fmt.Sprintf("key%d", j))); err != ErrKeyNotFound {
+			t.Errorf("expected %v for a failed write, got %v", ErrKeyNotFound, err)
+		}
+	}
+}
+
+func TestDatabase_WriteGroupSize(t *testing.T) {
+	db := &Database{}
+	for _, size := range []int{100, maxWriteGroupSize / 2, maxWriteGroupSize/2 - 100, 100, 2 * maxWriteGroupSize, 100} {
+		db.writers = append(db.writers, &writer{size: size})
+	}
+	//a writer larger than the limit is committed on its own
+	expected := []int{3, 1, 1, 1}
+	for _, n := range expected {
+		group := db.writeGroup()
+		if len(group) != n {
+			t.Fatalf("expected a group of %d writers, got %d", n, len(group))
+		}
+		db.writers = db.writers[n:]
+	}
+	if len(db.writers) != 0 {
+		t.Errorf("expected every writer in a group, %d left", len(db.writers))
+	}
+}
+
+func TestDatabase_DamagedLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{UseCompression: true, CompactionTrigger: -1}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	for j := 0; j < 10; j++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%d", j)), []byte(fmt.Sprintf("value%d", j))); err != nil {
+			t.Fatal("failed to put", err)
+		}
+	}
+	writeTestTable(t, db, map[string]string{"a": "1"})
+	db.Close()
+
+	//a flipped bit in the length of the first record makes it run past the end of the log
+	logFile := filepath.Join(dir, CurrentLog)
+	data, err := ioutil.ReadFile(logFile)
+	if err != nil {
+		t.Fatal("failed to read log", err)
+	}
+	data[6] ^= 0x01
+	if err := ioutil.WriteFile(logFile, data, os.ModePerm); err != nil {
+		t.Fatal("failed to write log", err)
+	}
+	if _, err := Open(dir, &opts); errors.Cause(err) != wal.ErrCorrupt {
+		t.Errorf("expected %v, got %v", wal.ErrCorrupt, err)
+	}
+	if after, err := ioutil.ReadFile(logFile); err != nil || !bytes.Equal(after, data) {
+		t.Errorf("expected the damaged log to be left as it is, got %d bytes and %v", len(after), err)
+	}
+	//the database which failed to open released its SSTables and its lock
+	if n, m := openFiles(t, dir), mappedFiles(t, dir); n != 0 || m != 0 {
+		t.Errorf("expected no open or mapped sstable, got %d open and %d mapped", n, m)
+	}
+	fs := NewFS(dir, &opts)
+	if _, err := fs.OpenDB(); err != nil {
+		t.Error("expected the lock to be released", err)
+	}
+	fs.Close()
+}
+
+/*
+TestDatabase_CrashWriter is not a test on its own. It is run in a child process by TestDatabase_RecoverAfterCrash
+and keeps writing keys, reporting each acknowledged write on stdout, until it is killed.
+ */
+func TestDatabase_CrashWriter(t *testing.T) {
+	dir := os.Getenv("GOKVSTORE_CRASH_DIR")
+	if dir == "" {
+		t.Skip("only runs as the child of TestDatabase_RecoverAfterCrash")
+	}
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      true,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	for j := 0; ; j++ {
+		if err := db.Put([]byte(fmt.Sprintf("key%08d", j)), []byte(fmt.Sprintf("value%08d", j))); err != nil {
+			t.Fatal("failed to put", err)
+		}
+		fmt.Println(j)
+	}
+}
+
+func TestDatabase_RecoverAfterCrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDatabase_CrashWriter$")
+	cmd.Env = append(os.Environ(), "GOKVSTORE_CRASH_DIR="+dir)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal("failed to create pipe", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal("failed to start writer", err)
+	}
+	acked := -1
+	scanner := bufio.NewScanner(stdout)
+	for acked < 1000 && scanner.Scan() {
+		if j, err := strconv.Atoi(scanner.Text()); err == nil {
+			acked = j
+		}
+	}
+	cmd.Process.Kill()
+	cmd.Wait()
+	if acked < 1000 {
+		t.Fatalf("writer stopped after %d writes", acked+1)
+	}
+
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		t.Fatal("failed to reopen database", err)
+	}
+	defer db.Close()
+	for j := 0; j <= acked; j++ {
+		val, err := db.Get([]byte(fmt.Sprintf("key%08d", j)))
+		if err != nil {
+			t.Fatalf("key%08d lost after crash: %v", j, err)
+		}
+		if !bytes.Equal(val, []byte(fmt.Sprintf("value%08d", j))) {
+			t.Errorf("expected %s, got %s", fmt.Sprintf("value%08d", j), val)
+		}
+	}
+}
+
+func BenchmarkDatabase_Put(b *testing.B) {
+	dir := "/tmp/test"
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		b.Error("failed to open database", err)
+	}
+
+	for j := 0; j < b.N; j++ {
+		err := db.Put(randomBytes(5), randomBytes(5))
+		if err != nil {
+			b.Error("failed to put", err)
+		}
+	}
+	db.Close()
+
+}
+
+func BenchmarkDatabase_PutParallelSync(b *testing.B) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		b.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      true,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		b.Fatal("failed to open database", err)
+	}
+	var n int64
+	b.SetParallelism(16)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := []byte(fmt.Sprintf("key%012d", atomic.AddInt64(&n, 1)))
+			if err := db.Put(key, key); err != nil {
+				b.Error("failed to put", err)
+			}
+		}
+	})
+	b.StopTimer()
+	db.Close()
+}
+
+func BenchmarkDatabase_Get(b *testing.B) {
+	dir := "/tmp/test"
+	opts := Options{
+		ReadOnly:       false,
+		UseCompression: true,
+		SyncWrite:      false,
+	}
+	db, err := Open(dir, &opts)
+	if err != nil {
+		b.Error("failed to open database", err)
+	}
+	testKeys := make([][]byte, 0)
+	for j := 0; j < 2.5*filterSize; j++ {
+		k := randomBytes(5)
+		testKeys = append(testKeys, k)
+		db.Put(k, randomBytes(5))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := db.Get(testKeys[i%len(testKeys)])
+		if err != nil {
+			b.Error("failed to get", err)
+		}
+	}
+	db.Close()
+
+}
+
+const charset = "abcdefghijklmnopqrstuvwxyz" +
+	"ABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+var seededRand = rand.New(rand.NewSource(time.Now().UnixNano()))
+
+func bytesWithCharset(length int, charset string) []byte {
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = charset[seededRand.Intn(len(charset))]
+	}
+	return b
+}
+
+func randomBytes(length int) []byte {
+	return bytesWithCharset(length, charset)
+}
+
+func TestDatabase_TableProperties(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	writeTestTable(t, db, map[string]string{"a": "1", "b": "2", "c": deleteMarker})
+	writeTestTable(t, db, map[string]string{"x": "1", "y": "2"})
+
+	props, err := db.TableProperties()
+	if err != nil {
+		t.Fatal("TableProperties failed", err)
+	}
+	if len(props) != 2 {
+		t.Fatalf("expected the properties of 2 tables, got %d", len(props))
+	}
+	for id, p := range props {
+		switch string(p.MinKey) {
+		case "a":
+			if p.NumEntries != 3 || p.NumTombstones != 1 || string(p.MaxKey) != "c" {
+				t.Errorf("table %s: expected 3 entries from a to c with a tombstone, got %+v", id, p)
+			}
+		case "x":
+			if p.NumEntries != 2 || p.NumTombstones != 0 || string(p.MaxKey) != "y" {
+				t.Errorf("table %s: expected 2 entries from x to y, got %+v", id, p)
+			}
+		default:
+			t.Errorf("table %s: unexpected properties %+v", id, p)
+		}
+	}
+}
+
+func TestDatabase_TablePropertiesDuringCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true, CompactionTrigger: 2})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	//the tables listed by TableProperties are not deleted by the compactions running meanwhile
+	stop := make(chan struct{})
+	done := make(chan error)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				done <- nil
+				return
+			default:
+			}
+			if _, err := db.TableProperties(); err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	for j := uint64(1); j <= 10; j++ {
+		writeTestTable(t, db, map[string]string{fmt.Sprintf("a%d", j): "1"})
+		writeTestTable(t, db, map[string]string{fmt.Sprintf("b%d", j): "1"})
+		db.scheduleCompaction()
+		for start := time.Now(); db.Stats().Compactions < j; time.Sleep(time.Millisecond) {
+			if time.Since(start) > 10*time.Second {
+				t.Fatalf("expected the tables to be compacted, got %+v", db.Stats())
+			}
+		}
+	}
+	close(stop)
+	if err := <-done; err != nil {
+		t.Error("TableProperties failed", err)
+	}
+}
+
+func TestDatabase_SingleFileTables(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	writeTestTable(t, db, map[string]string{"a": "1", "b": "2"})
+	if _, err := db.Close(); err != nil {
+		t.Fatal("failed to close database", err)
+	}
+
+	db, err = Open(dir, &Options{UseCompression: true, SingleFileTables: true})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	writeTestTable(t, db, map[string]string{"b": "3", "c": "4"})
+	//a table left incomplete by a crash
+	sst, err := db.fs.NewSSTable()
+	if err != nil {
+		t.Fatal("failed to create sstable", err)
+	}
+	w := NewWriterWithOptions(sst, db.options)
+	w.Set([]byte("d"), []byte("5"))
+	sst.Close()
+	if _, err := db.Close(); err != nil {
+		t.Fatal("failed to close database", err)
+	}
+
+	//tables of both layouts are read, whatever the options
+	db, err = Open(dir, &Options{UseCompression: true})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	if tmp, _ := filepath.Glob(dir + "/*" + tmpFileExt); len(tmp) != 0 {
+		t.Errorf("expected incomplete tables to be deleted, got %v", tmp)
+	}
+	if len(db.tables) != 2 {
+		t.Fatalf("expected 2 tables, got %v", db.tables)
+	}
+	for k, v := range map[string]string{"a": "1", "b": "3", "c": "4"} {
+		if val, err := db.Get([]byte(k)); err != nil || string(val) != v {
+			t.Errorf("expected %s for %s, got %s, %v", v, k, val, err)
+		}
+	}
+	if _, err := db.Get([]byte("d")); err != ErrKeyNotFound {
+		t.Errorf("expected d not to be found, got %v", err)
+	}
+}
+
+func TestDatabase_BackgroundCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true, CompactionTrigger: 3})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	writeTestTable(t, db, map[string]string{"a": "1", "b": "1", "c": "1"})
+	writeTestTable(t, db, map[string]string{"b": "2", "c": deleteMarker})
+	writeTestTable(t, db, map[string]string{"a": "3", "d": "3"})
+	old := db.currentTables()
+	db.scheduleCompaction()
+	for start := time.Now(); db.Stats().Compactions == 0; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 10*time.Second {
+			t.Fatalf("expected the tables to be compacted, got %+v", db.Stats())
+		}
+	}
+	tables := db.currentTables()
+	if len(tables) != 1 {
+		t.Fatalf("expected a single table after compaction, got %v", tables)
+	}
+	if files := GetDataFiles(dir); len(files) != 1 || files[0] != tables[0] {
+		t.Errorf("expected the compacted tables to be deleted, got %v", files)
+	}
+	//a compaction output is written as a single file, which a crash cannot leave half written
+	if _, err := os.Stat(filepath.Join(dir, tables[0]+tableFileExt)); err != nil {
+		t.Errorf("expected the compacted table to be a single file, got %v", err)
+	}
+	props, err := db.TableProperties()
+	if err != nil {
+		t.Fatal("TableProperties failed", err)
+	}
+	if p := props[tables[0]]; p.Sequence != 3 || strings.Join(p.CompactionInputs, ",") != strings.Join(old, ",") {
+		t.Errorf("expected sequence 3 and inputs %v, got %d and %v", old, p.Sequence, p.CompactionInputs)
+	}
+	expected := map[string]string{"a": "3", "b": "2", "d": "3"}
+	for k, v := range expected {
+		if val, err := db.Get([]byte(k)); err != nil || string(val) != v {
+			t.Errorf("expected %s for %s, got %s, %v", v, k, val, err)
+		}
+	}
+	if _, err := db.Get([]byte("c")); err != ErrKeyNotFound {
+		t.Errorf("expected c to be deleted, got %v", err)
+	}
+	if _, err := db.Close(); err != nil {
+		t.Fatal("failed to close database", err)
+	}
+}
+
+func TestDatabase_CompactionOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{UseCompression: true, CompactionTrigger: -1})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	writeTestTable(t, db, map[string]string{"a": "1", "b": "1"})
+	writeTestTable(t, db, map[string]string{"a": "2"})
+	writeTestTable(t, db, map[string]string{"a": "3", "c": "3"})
+	tables := db.currentTables()
+	//the two oldest tables are compacted after the newest table was written, as if by a crashed
+	//compaction which did not delete its inputs
+	c := &Compactor{fs: db.fs, cache: db.cache}
+	cs := c.compactBucket(&bucket{files: tables[1:]})
+	if cs.err != nil {
+		t.Fatal("failed to compact", cs.err)
+	}
+	if cs.numKeysBeforeCompaction != 3 || cs.numKeysAfterCompaction != 2 {
+		t.Errorf("expected 3 keys compacted into 2, got %d into %d", cs.numKeysBeforeCompaction, cs.numKeysAfterCompaction)
+	}
+	if _, err := db.Close(); err != nil {
+		t.Fatal("failed to close database", err)
+	}
+
+	db, err = Open(dir, &Options{UseCompression: true, CompactionTrigger: -1})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	if got := db.currentTables(); len(got) != 2 || got[0] != tables[0] || got[1] != cs.outputs[0] {
+		t.Errorf("expected tables %s and %s, got %v", tables[0], cs.outputs, got)
+	}
+	if files := GetDataFiles(dir); len(files) != 2 {
+		t.Errorf("expected the compacted tables to be deleted, got %v", files)
+	}
+	for k, v := range map[string]string{"a": "3", "b": "1", "c": "3"} {
+		if val, err := db.Get([]byte(k)); err != nil || string(val) != v {
+			t.Errorf("expected %s for %s, got %s, %v", v, k, val, err)
+		}
+	}
+}
+
+func TestDatabase_LeveledCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := Open(dir, &Options{CompactionStyle: LeveledCompaction + 1}); err != ErrUnknownCompactionStyle {
+		t.Fatalf("expected ErrUnknownCompactionStyle, got %v", err)
+	}
+	opts := &Options{
+		Compression:       NoCompression,
+		CompactionTrigger: -1,
+		CompactionStyle:   LeveledCompaction,
+		LevelBaseSize:     32 << 10,
+		TargetTableSize:   8 << 10,
+	}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	//every table overwrites the keys of the table before it, and deletes some of them
+	expected := make(map[string]string)
+	for r := 0; r < 8; r++ {
+		records := make(map[string]string)
+		for i := r * 150; i < r*150+600; i++ {
+			k := fmt.Sprintf("key%05d", i)
+			records[k] = fmt.Sprintf("%d-%s", r, strings.Repeat("v", 200))
+			if i%7 == r {
+				records[k] = deleteMarker
+			}
+			expected[k] = records[k]
+		}
+		writeTestTable(t, db, records)
+	}
+	//the background compaction is not running, the levels are compacted here
+	opts.CompactionTrigger = 2
+	db.compactLevels(nil)
+	if db.Stats().Compactions == 0 {
+		t.Fatalf("expected the tables to be compacted, got %+v", db.Stats())
+	}
+
+	tables, meta := db.currentState()
+	l := levels(tables, meta)
+	if len(l[0]) != 0 {
+		t.Errorf("expected level 0 to be compacted, got %v", l[0])
+	}
+	if len(l[2]) == 0 {
+		t.Errorf("expected more than one level, got %v", l)
+	}
+	props, err := db.TableProperties()
+	if err != nil {
+		t.Fatal("TableProperties failed", err)
+	}
+	for level, ids := range l[1:] {
+		var size uint64
+		for i, id := range ids {
+			if props[id].Level != level+1 {
+				t.Errorf("expected table %s in level %d, got %d", id, level+1, props[id].Level)
+			}
+			if i > 0 && bytes.Compare(props[ids[i-1]].MaxKey, props[id].MinKey) >= 0 {
+				t.Errorf("tables %s and %s of level %d overlap", ids[i-1], id, level+1)
+			}
+			size += props[id].DataSize
+		}
+		if size > db.levelMaxSize(level+1) {
+			t.Errorf("expected level %d to hold at most %d bytes, got %d", level+1, db.levelMaxSize(level+1), size)
+		}
+	}
+	if files := GetDataFiles(dir); len(files) != len(tables) {
+		t.Errorf("expected the compacted tables to be deleted, got %v", files)
+	}
+
+	check := func(db *Database) {
+		for k, v := range expected {
+			val, err := db.Get([]byte(k))
+			if v == deleteMarker {
+				if err != ErrKeyNotFound {
+					t.Fatalf("expected %s to be deleted, got %v", k, err)
+				}
+			} else if err != nil || string(val) != v {
+				t.Fatalf("expected %s for %s, got %s, %v", v, k, val, err)
+			}
+		}
+		//a scan merges the levels, returning the newest value of every key
+		iter, err := db.NewIterator(nil, nil)
+		if err != nil {
+			t.Fatal("NewIterator failed", err)
+		}
+		defer iter.Close()
+		n := 0
+		for iter.Next() {
+			if v := expected[string(iter.Key())]; v != string(iter.Value()) {
+				t.Fatalf("expected %s for %s, got %s", v, iter.Key(), iter.Value())
+			}
+			n++
+		}
+		live := 0
+		for _, v := range expected {
+			if v != deleteMarker {
+				live++
+			}
+		}
+		if n != live {
+			t.Errorf("expected %d keys, got %d", live, n)
+		}
+	}
+	check(db)
+	if _, err := db.Close(); err != nil {
+		t.Fatal("failed to close database", err)
+	}
+
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	if got := db.currentTables(); strings.Join(got, ",") != strings.Join(tables, ",") {
+		t.Errorf("expected tables %v after reopening, got %v", tables, got)
+	}
+	check(db)
+}
+
+func TestDatabase_TombstoneGracePeriod(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	const grace = 300 * time.Millisecond
+	db, err := Open(dir, &Options{UseCompression: true, CompactionTrigger: -1, TombstoneGracePeriod: grace})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	writeTestTable(t, db, map[string]string{"a": "1"})
+	deleted := time.Now()
+	writeTestTable(t, db, map[string]string{"b": deleteMarker})
+
+	compact := func() compactionStats {
+		tables, meta := db.currentState()
+		c := &Compactor{fs: db.fs, cache: db.cache, tables: tables, meta: meta}
+		b := &bucket{files: tables}
+		cs := c.compactBucket(b)
+		if !db.compacted(b.files, cs) {
+			t.Fatal("failed to compact", cs.err)
+		}
+		return cs
+	}
+	time.Sleep(grace * 2 / 3)
+	if cs := compact(); cs.tombstonesPurged != 0 {
+		t.Fatalf("expected the tombstone to be kept within the grace period, purged %d", cs.tombstonesPurged)
+	}
+	props, err := db.TableProperties()
+	if err != nil {
+		t.Fatal("TableProperties failed", err)
+	}
+	for id, p := range props {
+		if p.DeletionTime.Before(deleted) || p.DeletionTime.After(deleted.Add(grace/3)) {
+			t.Errorf("expected %s to keep the deletion time %v, got %v", id, deleted, p.DeletionTime)
+		}
+	}
+	//the grace period has passed since the key was deleted, but not since the last compaction
+	time.Sleep(time.Until(deleted.Add(grace + grace/6)))
+	if cs := compact(); cs.tombstonesPurged != 1 {
+		t.Errorf("expected the tombstone to be purged once the grace period has passed, purged %d", cs.tombstonesPurged)
+	}
+}
+
+func TestDatabase_TombstoneGC(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := &Options{UseCompression: true, CompactionTrigger: -1}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	writeTestTable(t, db, map[string]string{"a": "1", "b": "1", "c": "1"})
+	writeTestTable(t, db, map[string]string{"b": deleteMarker})
+	writeTestTable(t, db, map[string]string{"c": deleteMarker, "d": "1"})
+
+	compact := func(n int) compactionStats {
+		tables, meta := db.currentState()
+		c := &Compactor{fs: db.fs, cache: db.cache, tables: tables, meta: meta}
+		b := &bucket{files: tables[:n]}
+		cs := c.compactBucket(b)
+		if !db.compacted(b.files, cs) {
+			t.Fatal("failed to compact", cs.err)
+		}
+		return cs
+	}
+	tombstones := func() uint64 {
+		props, err := db.TableProperties()
+		if err != nil {
+			t.Fatal("TableProperties failed", err)
+		}
+		var n uint64
+		for _, p := range props {
+			n += p.NumTombstones
+		}
+		return n
+	}
+	//the oldest table holds older values of the deleted keys
+	if cs := compact(2); cs.tombstonesPurged != 0 || tombstones() != 2 {
+		t.Errorf("expected the tombstones to be kept, purged %d, left %d", cs.tombstonesPurged, tombstones())
+	}
+	//the tombstones are within the grace period
+	opts.TombstoneGracePeriod = time.Hour
+	if cs := compact(2); cs.tombstonesPurged != 0 || tombstones() != 2 {
+		t.Errorf("expected the tombstones to be kept, purged %d, left %d", cs.tombstonesPurged, tombstones())
+	}
+	opts.TombstoneGracePeriod = 0
+	cs := compact(1)
+	if cs.tombstonesPurged != 2 || cs.numKeysAfterCompaction != 2 || tombstones() != 0 {
+		t.Errorf("expected 2 tombstones to be purged, purged %d, kept %d keys and %d tombstones", cs.tombstonesPurged, cs.numKeysAfterCompaction, tombstones())
+	}
+	if stats := db.Stats(); stats.TombstonesPurged != 2 {
+		t.Errorf("expected 2 tombstones purged, got %+v", stats)
+	}
+	for k, v := range map[string]string{"a": "1", "d": "1"} {
+		if val, err := db.Get([]byte(k)); err != nil || string(val) != v {
+			t.Errorf("expected %s for %s, got %s, %v", v, k, val, err)
+		}
+	}
+	for _, k := range []string{"b", "c"} {
+		if _, err := db.Get([]byte(k)); err != ErrKeyNotFound {
+			t.Errorf("expected %s to be deleted, got %v", k, err)
+		}
+	}
+}
+
+func TestDatabase_EmptyCompactionOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	opts := &Options{UseCompression: true, CompactionTrigger: -1}
+	db, err := Open(dir, opts)
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	writeTestTable(t, db, map[string]string{"a": deleteMarker, "b": deleteMarker})
+	tables, meta := db.currentState()
+	c := &Compactor{fs: db.fs, cache: db.cache, tables: tables, meta: meta}
+	cs := c.compactBucket(&bucket{files: tables})
+	if cs.err != nil || cs.tombstonesPurged != 2 || len(cs.emptyOutputs()) != 1 {
+		t.Fatalf("expected every key to be purged into an empty table, got %+v", cs)
+	}
+	//the empty table is not used, and is deleted with the inputs
+	if !db.compacted(tables, cs) {
+		t.Fatal("failed to compact", cs.err)
+	}
+	if got := db.currentTables(); len(got) != 0 {
+		t.Errorf("expected no table, got %v", got)
+	}
+	if files := GetDataFiles(dir); len(files) != 0 {
+		t.Errorf("expected the empty table to be deleted, got %v", files)
+	}
+
+	//an empty table left behind by a crash is deleted after its inputs when the database is opened
+	writeTestTable(t, db, map[string]string{"c": deleteMarker})
+	tables, meta = db.currentState()
+	c = &Compactor{fs: db.fs, cache: db.cache, tables: tables, meta: meta}
+	if cs := c.compactBucket(&bucket{files: tables}); cs.err != nil || len(cs.emptyOutputs()) != 1 {
+		t.Fatalf("expected an empty table, got %+v", cs)
+	}
+	if files := GetDataFiles(dir); len(files) != 2 {
+		t.Fatalf("expected the input and the empty table, got %v", files)
+	}
+	db.Close()
+	db, err = Open(dir, opts)
+	if err != nil {
+		t.Fatal("failed to reopen database", err)
+	}
+	defer db.Close()
+	if files := GetDataFiles(dir); len(files) != 0 || len(db.currentTables()) != 0 {
+		t.Errorf("expected no table after reopening, got %v and %v", files, db.currentTables())
+	}
 }
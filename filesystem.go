@@ -18,6 +18,8 @@ import (
 	"github.com/pkg/errors"
 	"os"
 	"path"
+	"path/filepath"
+	"sync"
 	"syscall"
 )
 
@@ -32,6 +34,10 @@ const (
 	metaFileExt       = ".meta"
 	//filterFileExt is the extension of the filter files
 	filterFileExt     = ".filter"
+	//tableFileExt is the extension of the SSTables written as a single file
+	tableFileExt      = ".sst"
+	//tmpFileExt is appended to the name of a single file SSTable until it is completely written
+	tmpFileExt        = ".tmp"
 )
 
 var (
@@ -55,12 +61,19 @@ Filesystem provided abstractions for interacting with the underlying file system
 type FileSystem struct {
 	path    string
 	options *Options
+	//last is the time of the last SSTable id handed out, ids are unique even when SSTables are created
+	//within the same millisecond, for instance by a flush and a compaction
+	lock    sync.Mutex
+	last    time.Time
+	//lockFile holds the lock on the directory from OpenDB until Close
+	lockFile *os.File
 }
 
 /*
 OpenDB accepts the path which is specified by the client. It creates the database directory if it does not exist.
 It obtains a lock on the directory. If the client options is ReadOnly, a shared lock is acquired, else an exclusive
-lock is acquired.
+lock is acquired. The lock is held until Close, and ErrTimeout is returned if the directory stays locked by
+another user of the database.
  */
 func (fs *FileSystem) OpenDB() (ok bool, error error) {
 
@@ -72,12 +85,8 @@ func (fs *FileSystem) OpenDB() (ok bool, error error) {
 		}
 
 	}
-	_, err = os.Stat(path.Join(fs.path, lockFileName))
-	if os.IsNotExist(err) {
-		if ok, err = fs.obtainLock(fs.options.ReadOnly); err != nil {
-			return ok, errors.Wrap(err, "can't obtain lock on database")
-		}
-
+	if ok, err = fs.obtainLock(fs.options.ReadOnly); err != nil {
+		return ok, errors.Wrap(err, "can't obtain lock on database")
 	}
 	return true, nil
 }
@@ -87,38 +96,51 @@ func (fs *FileSystem) createDir() (err error) {
 	if err != nil {
 		return errors.Wrap(err, "can't make directories for new database")
 	}
-	_, err = fs.obtainLock(false)
-	return err
+	return nil
 }
 
 func (fs *FileSystem) obtainLock(readonly bool) (ok bool, err error) {
 	lock := path.Join(fs.path, lockFileName)
-	lockfile, err := os.Create(lock)
+	lockfile, err := os.OpenFile(lock, os.O_CREATE|os.O_RDWR, 0644)
 	if err != nil {
 		return false, errors.Wrap(err, "can't obtain lock on data directory")
 	}
-	if !readonly {
-		err := flock(int(lockfile.Fd()), true, time.Millisecond*500)
-		if err != nil {
-			return false, errors.Wrap(err, "failed to lock directory")
-
-		}
-	} else {
-		err := flock(int(lockfile.Fd()), false, time.Millisecond*500)
-		if err != nil {
-			return false, errors.Wrap(err, "failed to lock directory")
-
-		}
+	if err := flock(int(lockfile.Fd()), !readonly, time.Millisecond*500); err != nil {
+		lockfile.Close()
+		return false, errors.Wrap(err, "failed to lock directory")
 	}
-
+	fs.lockFile = lockfile
 	return true, nil
 }
 
 /*
 NewSSTable creates and returns a new SSTable. The id of the SSTable is based on timestamp.
+If the options ask for single file SSTables, the SSTable is created under a temporary name, and only
+gets its name once the Writer is closed.
  */
 func (fs *FileSystem) NewSSTable() (sst *SSTable, err error) {
-	id := sstId()
+	return fs.newSSTable(fs.options.SingleFileTables)
+}
+
+/*
+newSSTable creates a new SSTable, written as a single file if singleFile is set whatever the options.
+ */
+func (fs *FileSystem) newSSTable(singleFile bool) (sst *SSTable, err error) {
+	id := fs.sstId()
+	if singleFile {
+		name := id + tableFileExt
+		f, err := fs.OpenFile(name+tmpFileExt, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.ModePerm)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to create new sstable")
+		}
+		return &SSTable{
+			id:       id,
+			datafile: f,
+			dir:      fs.path,
+			path:     path.Join(fs.path, name),
+			tmpPath:  path.Join(fs.path, name+tmpFileExt),
+		}, nil
+	}
 	df, err := fs.OpenFile(id+dataFileExt, os.O_CREATE|os.O_APPEND|os.O_WRONLY, os.ModePerm)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to create new sstable")
@@ -137,13 +159,39 @@ func (fs *FileSystem) NewSSTable() (sst *SSTable, err error) {
 		datafile:   df,
 		metafile:   mf,
 		filterfile: lf,
+		dir:        fs.path,
 	}, nil
 }
 
 /*
-OpenSSTable opens the SSTable specified by the id.
+syncDir syncs the directory at path, so that the files created, renamed or deleted in it are durable.
+ */
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
+}
+
+/*
+OpenSSTable opens the SSTable specified by the id, whether it is a single file or not.
  */
 func (fs *FileSystem) OpenSSTable(id string) (sst *SSTable, err error) {
+	f, err := fs.OpenFile(id+tableFileExt, os.O_RDONLY, os.ModePerm)
+	if err == nil {
+		return &SSTable{
+			id:       id,
+			datafile: f,
+		}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed to open sstable")
+	}
 	df, err := fs.OpenFile(id+dataFileExt, os.O_RDONLY, os.ModePerm)
 	if err != nil {
 		return nil, errors.Wrap(err, "failed to open sstable")
@@ -166,14 +214,22 @@ func (fs *FileSystem) OpenSSTable(id string) (sst *SSTable, err error) {
 }
 
 /*
-DeleteSSTable deletes the SSTable identified by the id.
+DeleteSSTable deletes the SSTable identified by the id, including a single file SSTable which is not complete.
  */
 func (fs *FileSystem) DeleteSSTable(id string) error {
 	dataFile := id + dataFileExt
 	metaFile := id + metaFileExt
 	filterFile := id + filterFileExt
 
-	err := fs.DeleteFile(dataFile)
+	err := fs.DeleteFile(id + tableFileExt)
+	if err != nil {
+		return err
+	}
+	err = fs.DeleteFile(id + tableFileExt + tmpFileExt)
+	if err != nil {
+		return err
+	}
+	err = fs.DeleteFile(dataFile)
 	if err != nil {
 		return err
 	}
@@ -189,19 +245,38 @@ func (fs *FileSystem) DeleteSSTable(id string) error {
 }
 
 /*
-Close releases the lock which has been acquired. If the lock is an exclusive lock, we try to release it.
-For a shared lock, it is a no-op.
+DeleteTempFiles deletes the single file SSTables which were left incomplete, for instance by a crash
+while they were written.
  */
-func (fs *FileSystem) Close() (ok bool, error error) {
-	lock, err := os.Open(path.Join(fs.path, lockFileName))
+func (fs *FileSystem) DeleteTempFiles() error {
+	names, err := filepath.Glob(path.Join(fs.path, "*"+tableFileExt+tmpFileExt))
 	if err != nil {
-		return false, errors.Wrap(err, "failed to open lock file")
+		return err
 	}
-	if !fs.options.ReadOnly {
-		if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_UN); err != nil {
-			return false, errors.Wrap(err, "db.Close(): unlock error:")
+	for _, name := range names {
+		if err := os.Remove(name); err != nil {
+			return errors.Wrap(err, "failed to delete incomplete sstable")
 		}
+	}
+	return nil
+}
 
+/*
+Close releases the lock which has been acquired by OpenDB, whether it is an exclusive or a shared lock.
+Close does nothing if the lock is not held.
+ */
+func (fs *FileSystem) Close() (ok bool, error error) {
+	if fs.lockFile == nil {
+		return true, nil
+	}
+	lock := fs.lockFile
+	fs.lockFile = nil
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_UN); err != nil {
+		lock.Close()
+		return false, errors.Wrap(err, "db.Close(): unlock error:")
+	}
+	if err := lock.Close(); err != nil {
+		return false, errors.Wrap(err, "failed to close lock file")
 	}
 	return true, nil
 }
@@ -243,6 +318,12 @@ func (fs *FileSystem) DeleteFile(name string) (err error) {
 	return os.Remove(path.Join(fs.path, name))
 }
 /*
+TruncateFile truncates the file with the specified name to the given size.
+ */
+func (fs *FileSystem) TruncateFile(name string, size int64) (err error) {
+	return os.Truncate(path.Join(fs.path, name), size)
+}
+/*
 OpenLogFile opens the write ahead log file. If the file does not exist, it is created.
  */
 func (fs *FileSystem) OpenLogFile(name string) (file *os.File, error error) {
@@ -273,8 +354,14 @@ func flock(fd int, exclusive bool, timeout time.Duration) error {
 	}
 }
 
-func sstId() string {
-	t := currentTime()
+func (fs *FileSystem) sstId() string {
+	fs.lock.Lock()
+	defer fs.lock.Unlock()
+	t := currentTime().Truncate(time.Millisecond)
+	if !t.After(fs.last) {
+		t = fs.last.Add(time.Millisecond)
+	}
+	fs.last = t
 	return t.Format(DefaultNameFormat)
 }
 /*
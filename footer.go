@@ -0,0 +1,117 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package gokvstore
+
+import (
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	//tableMagic ends the footer of every SSTable, it reads "gokvstor" in little endian
+	tableMagic uint64 = 0x726f7473766b6f67
+	//legacyFormatVersion is the version of the SSTables written before SSTables had a footer. Their meta file
+	//does not end with the magic number, and holds a key index encoded with gob.
+	legacyFormatVersion = 0
+	//tableFormatVersion is the version of the format of the SSTables written by this version
+	tableFormatVersion = 2
+	//footerTrailerSize is the size of the end of the footer, which is laid out the same in every version.
+	//It holds the format version and the CRC32C of the metadata, followed by the magic number.
+	footerTrailerSize = 16
+	//footerSizeV1 is the size of the footer of the first version of the format, which only had a meta
+	//file. It holds the number of entries of the index and the offset of the properties block.
+	footerSizeV1 = 28
+	//footerSize is the size of the footer of the current version. It holds the offset of the metadata
+	//and the length of the filter block at its start, the offset of the properties block and the number
+	//of entries of the index.
+	footerSize = 44
+)
+
+//errNoFooter is returned when a file does not end with the magic number.
+var errNoFooter = errors.New("bad magic number")
+
+/*
+footer locates the metadata of an SSTable in the file holding the footer, which is the meta file or the
+single file of the SSTable. The metadata is the filter block, if the filter is not in a file of its own,
+followed by the sparse index, the properties block and the footer itself. The checksum covers the
+metadata up to the checksum. All numbers are stored in little endian.
+ */
+type footer struct {
+	metaOffset   uint64
+	filterLength uint64
+	propsOffset  uint64
+	numBlocks    uint32
+	version      uint32
+	checksum     uint32
+}
+
+/*
+size returns the size of the footer in the file.
+ */
+func (f *footer) size() int {
+	if f.version == 1 {
+		return footerSizeV1
+	}
+	return footerSize
+}
+
+/*
+encode returns the footer in the current format. The checksum is left out, it is computed over the
+metadata including the first part of the footer, which ends at footerSize-12.
+ */
+func (f *footer) encode() []byte {
+	b := make([]byte, footerSize)
+	binary.LittleEndian.PutUint64(b[0:], f.metaOffset)
+	binary.LittleEndian.PutUint64(b[8:], f.filterLength)
+	binary.LittleEndian.PutUint64(b[16:], f.propsOffset)
+	binary.LittleEndian.PutUint32(b[24:], f.numBlocks)
+	binary.LittleEndian.PutUint32(b[28:], tableFormatVersion)
+	binary.LittleEndian.PutUint64(b[36:], tableMagic)
+	return b
+}
+
+/*
+decodeFooter decodes the footer at the end of b, which holds the end of the file. The magic number and
+the version are checked first, since the version decides the size of the footer.
+ */
+func decodeFooter(b []byte) (footer, error) {
+	var f footer
+	if len(b) < footerTrailerSize || binary.LittleEndian.Uint64(b[len(b)-8:]) != tableMagic {
+		return f, errNoFooter
+	}
+	f.version = binary.LittleEndian.Uint32(b[len(b)-footerTrailerSize:])
+	f.checksum = binary.LittleEndian.Uint32(b[len(b)-12:])
+	switch f.version {
+	case 1:
+		if len(b) < footerSizeV1 {
+			return f, errors.New("footer too short")
+		}
+		h := b[len(b)-footerSizeV1:]
+		f.numBlocks = binary.LittleEndian.Uint32(h[0:])
+		f.propsOffset = binary.LittleEndian.Uint64(h[4:])
+	case tableFormatVersion:
+		if len(b) < footerSize {
+			return f, errors.New("footer too short")
+		}
+		h := b[len(b)-footerSize:]
+		f.metaOffset = binary.LittleEndian.Uint64(h[0:])
+		f.filterLength = binary.LittleEndian.Uint64(h[8:])
+		f.propsOffset = binary.LittleEndian.Uint64(h[16:])
+		f.numBlocks = binary.LittleEndian.Uint32(h[24:])
+	default:
+		return f, errors.Wrapf(ErrUnknownFormatVersion, "version %d", f.version)
+	}
+	return f, nil
+}
@@ -12,20 +12,134 @@
 
 package gokvstore
 
-import "encoding/binary"
+import (
+	"bytes"
+	"encoding/binary"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+/*
+Iterator iterates over the keys of the database in ascending order, and back. A new iterator is not
+positioned; the first call to Next moves it to the first key and the first call to Prev moves it to
+the last key. Each positioning method returns whether the iterator is positioned at a key.
+The slices returned by Key and Value are only valid until the iterator is moved.
+Iterating backward from a key, for example to read the latest keys before it, uses SeekForPrev and Prev.
+
+	iter, err := db.NewIterator([]byte("lower"), []byte("upper"))
+	for iter.Next() {
+	    k := iter.Key()
+	    v := iter.Value()
+	}
+	err = iter.Error()
+	iter.Close()
+ */
+type Iterator interface {
+	//First moves the iterator to the first key.
+	First() bool
+	//Last moves the iterator to the last key.
+	Last() bool
+	//Seek moves the iterator to the first key which is greater than or equal to key.
+	Seek(key []byte) bool
+	//SeekForPrev moves the iterator to the last key which is less than or equal to key.
+	SeekForPrev(key []byte) bool
+	//Next moves the iterator to the next key.
+	Next() bool
+	//Prev moves the iterator to the previous key.
+	Prev() bool
+	//Key returns the current key, or nil if the iterator is not positioned at a key.
+	Key() []byte
+	//Value returns the value of the current key, or nil if the iterator is not positioned at a key.
+	Value() []byte
+	//Error returns any error encountered while iterating.
+	Error() error
+	//Close releases the resources held by the iterator and returns any error encountered while iterating.
+	Close() error
+}
 
 /*
 chunkIterator is used to iterate over data blocks of an SSTable. It understands the structure of the
-SSTable. Each call to Next retrieves the current key and value and removes that from the current data
-byte slice.
+blocks written by a blockBuilder. Keys are prefix compressed, so an entry is decoded from the entries
+before it, back to the closest restart point. Seek binary searches the keys stored in full at the
+restart points, and scans the entries following the restart point it finds. Prev scans forward again
+from the restart point before the current entry.
  */
 
 type chunkIterator struct {
-	data       []byte
-	key, value []byte
-	err        error
-	start, End bool
-	numKeys    uint64
+	data        []byte
+	restarts    []byte
+	numRestarts int
+	//offset is the offset of the current entry, -1 before the first entry and len(data) after the last
+	offset      int
+	next        int
+	started     bool
+	key, value  []byte
+	err         error
+}
+
+/*
+First moves the iterator to the first key value pair in the block.
+ */
+func (i *chunkIterator) First() bool {
+	i.started = true
+	return i.seekRestart(0)
+}
+
+/*
+Last moves the iterator to the last key value pair in the block.
+ */
+func (i *chunkIterator) Last() bool {
+	i.started = true
+	if !i.seekRestart(i.numRestarts - 1) {
+		return false
+	}
+	for i.next < len(i.data) {
+		if !i.parseAt(i.next) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+Seek moves the iterator to the first key which is greater than or equal to key.
+ */
+func (i *chunkIterator) Seek(key []byte) bool {
+	i.started = true
+	r := sort.Search(i.numRestarts, func(r int) bool {
+		k := i.restartKey(r)
+		return k == nil || bytes.Compare(k, key) >= 0
+	})
+	//the key may be in the entries following the previous restart point
+	if r > 0 {
+		r--
+	}
+	if !i.seekRestart(r) {
+		return false
+	}
+	for bytes.Compare(i.key, key) < 0 {
+		if !i.parseAt(i.next) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+SeekForPrev moves the iterator to the last key which is less than or equal to key.
+ */
+func (i *chunkIterator) SeekForPrev(key []byte) bool {
+	if i.Seek(key) {
+		if bytes.Equal(i.key, key) {
+			return true
+		}
+		return i.Prev()
+	}
+	if i.err != nil {
+		return false
+	}
+	return i.Last()
 }
 
 /*
@@ -33,33 +147,161 @@ Next is used to traverse over the keys and values in the data slice. Each call t
 current key and value and advances to the next key value pair in the data slice.
  */
 func (i *chunkIterator) Next() bool {
-	if i.End || i.err != nil {
+	if !i.started || i.offset < 0 {
+		return i.First()
+	}
+	if i.offset < len(i.data) {
+		return i.parseAt(i.next)
+	}
+	return false
+}
+
+/*
+Prev moves the iterator to the previous key value pair in the block.
+ */
+func (i *chunkIterator) Prev() bool {
+	if !i.started || i.offset >= len(i.data) {
+		return i.Last()
+	}
+	if i.offset < 0 {
 		return false
 	}
-	if i.start {
-		i.start = false
-		return true
+	if i.offset == 0 {
+		return i.invalidate(-1)
 	}
-	if len(i.data) == 0 {
-		i.Close()
+	target := i.offset
+	r := sort.Search(i.numRestarts, func(r int) bool {
+		return i.restartPoint(r) >= target
+	}) - 1
+	if !i.seekRestart(r) {
 		return false
 	}
-	keylen, n0 := binary.Uvarint(i.data)
-	vallen, n1 := binary.Uvarint(i.data[n0:])
-	n := n0 + n1
-	i.key = i.data[n : n+int(keylen)]
-	i.value = i.data[n+int(keylen) : n+int(keylen+vallen)]
-	i.data = i.data[n+int(keylen+vallen):]
-	i.numKeys++
+	for i.next < target {
+		if !i.parseAt(i.next) {
+			return false
+		}
+	}
+	return true
+}
+
+func (i *chunkIterator) restartPoint(r int) int {
+	return int(binary.LittleEndian.Uint32(i.restarts[4*r:]))
+}
+
+/*
+restartKey returns the key of the entry at the r-th restart point, or nil if the entry cannot be decoded.
+ */
+func (i *chunkIterator) restartKey(r int) []byte {
+	off := i.restartPoint(r)
+	if off >= len(i.data) {
+		return nil
+	}
+	shared, unshared, _, n := decodeEntry(i.data[off:])
+	if n == 0 || shared != 0 {
+		return nil
+	}
+	return i.data[off+n : off+n+int(unshared)]
+}
+
+func (i *chunkIterator) seekRestart(r int) bool {
+	if r < 0 || r >= i.numRestarts {
+		return i.invalidate(len(i.data))
+	}
+	i.key = i.key[:0]
+	return i.parseAt(i.restartPoint(r))
+}
+
+/*
+parseAt decodes the entry at off, whose key shares its prefix with the current key.
+ */
+func (i *chunkIterator) parseAt(off int) bool {
+	if i.err != nil || off >= len(i.data) {
+		return i.invalidate(len(i.data))
+	}
+	shared, unshared, vallen, n := decodeEntry(i.data[off:])
+	if n == 0 || shared > uint64(len(i.key)) {
+		i.err = errors.Errorf("bad entry at %d", off)
+		return i.invalidate(len(i.data))
+	}
+	n += off
+	i.key = append(i.key[:shared], i.data[n:n+int(unshared)]...)
+	n += int(unshared)
+	i.value = i.data[n : n+int(vallen)]
+	i.offset, i.next = off, n+int(vallen)
 	return true
+}
+
+/*
+invalidate moves the iterator before the first entry if offset is negative, or after the last entry.
+ */
+func (i *chunkIterator) invalidate(offset int) bool {
+	i.started = true
+	if offset < 0 {
+		offset = -1
+	} else {
+		offset = len(i.data)
+	}
+	i.offset, i.next = offset, offset
+	i.key, i.value = i.key[:0], nil
+	return false
+}
+
+func (i *chunkIterator) valid() bool {
+	return i.offset >= 0 && i.offset < len(i.data)
+}
 
+/*
+check decodes every entry of the block, and verifies that the restart points are at the start of
+entries which store their key in full. The iterator is left unpositioned.
+ */
+func (i *chunkIterator) check() error {
+	r := 0
+	i.key = i.key[:0]
+	for off := 0; i.err == nil && off < len(i.data); off = i.next {
+		if r < i.numRestarts && i.restartPoint(r) == off {
+			i.key = i.key[:0]
+			r++
+		}
+		i.parseAt(off)
+	}
+	if i.err == nil && r != i.numRestarts {
+		i.err = errors.New("restart point inside an entry")
+	}
+	i.invalidate(-1)
+	i.started = false
+	return i.err
+}
+
+/*
+decodeEntry decodes the lengths at the start of an entry, and returns them with the size of their
+encoding, which is 0 if they cannot be decoded or the entry does not fit in data.
+ */
+func decodeEntry(data []byte) (shared, unshared, vallen uint64, n int) {
+	var m int
+	if shared, m = binary.Uvarint(data); m <= 0 {
+		return 0, 0, 0, 0
+	}
+	n = m
+	if unshared, m = binary.Uvarint(data[n:]); m <= 0 {
+		return 0, 0, 0, 0
+	}
+	n += m
+	if vallen, m = binary.Uvarint(data[n:]); m <= 0 {
+		return 0, 0, 0, 0
+	}
+	n += m
+	left := uint64(len(data) - n)
+	if unshared > left || vallen > left-unshared {
+		return 0, 0, 0, 0
+	}
+	return shared, unshared, vallen, n
 }
 
 /*
 Key returns the current key
  */
 func (i *chunkIterator) Key() []byte {
-	if i.start {
+	if !i.valid() {
 		return nil
 	}
 	return i.key[:len(i.key):len(i.key)]
@@ -69,30 +311,370 @@ func (i *chunkIterator) Key() []byte {
 Value returns the value associated with the current key.
  */
 func (i *chunkIterator) Value() []byte {
-	if i.start {
+	if !i.valid() {
 		return nil
 	}
 	return i.value[:len(i.value):len(i.value)]
 }
 
+/*
+Error returns the error encountered while decoding the block.
+ */
+func (i *chunkIterator) Error() error {
+	return i.err
+}
+
 /*
 Close closes the iterator, and resets it.
  */
 func (i *chunkIterator) Close() error {
-	i.key = nil
-	i.value = nil
-	i.End = true
+	i.invalidate(len(i.data))
 	return i.err
 }
 
 /*
-NewChunkIterator returns a new chunk iterator over the data slice passed to it.
+NewChunkIterator returns a new chunk iterator over the data slice passed to it, which holds a block
+built by a blockBuilder. If the restart points of the block are not valid, the iterator holds no
+entries and reports the error. The entries themselves are decoded as the iterator moves.
  */
 func NewChunkIterator(data []byte) *chunkIterator {
 	iter := &chunkIterator{
-		data:  data,
-		start: true,
-		End:   false,
+		offset: -1,
+		next:   -1,
+	}
+	if len(data) == 0 {
+		return iter
+	}
+	if len(data) < 4 {
+		iter.err = errors.New("block too short for its restart points")
+		return iter
+	}
+	n := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if uint64(n) > uint64(len(data)-4)/4 {
+		iter.err = errors.Errorf("bad number of restart points %d", n)
+		return iter
+	}
+	end := len(data) - 4 - 4*int(n)
+	restarts := data[end : len(data)-4]
+	prev := -1
+	for r := 0; r < int(n); r++ {
+		p := int(binary.LittleEndian.Uint32(restarts[4*r:]))
+		if (r == 0 && p != 0) || p <= prev || (p > 0 && p >= end) {
+			iter.err = errors.Errorf("bad restart point %d at %d", r, p)
+			return iter
+		}
+		prev = p
 	}
+	if end > 0 && n == 0 {
+		iter.err = errors.New("block has no restart point")
+		return iter
+	}
+	iter.data, iter.restarts, iter.numRestarts = data[:end], restarts, int(n)
 	return iter
 }
+
+/*
+tableIterator iterates over the keys of an SSTable. It reads one block at a time.
+ */
+type tableIterator struct {
+	r       *Reader
+	block   int
+	iter    *chunkIterator
+	err     error
+	//numKeys is the number of times the iterator was positioned at a key, the number of keys of the SSTable
+	//once it was scanned from the first key
+	numKeys uint64
+}
+
+/*
+counted counts a move of the iterator if it is positioned at a key.
+ */
+func (t *tableIterator) counted(ok bool) bool {
+	if ok {
+		t.numKeys++
+	}
+	return ok
+}
+
+/*
+First moves the iterator to the first key of the SSTable.
+ */
+func (t *tableIterator) First() bool {
+	if !t.loadBlock(0) {
+		return false
+	}
+	return t.counted(t.iter.First() || t.forward())
+}
+
+/*
+Last moves the iterator to the last key of the SSTable.
+ */
+func (t *tableIterator) Last() bool {
+	if !t.loadBlock(len(t.r.blocks) - 1) {
+		return false
+	}
+	return t.counted(t.iter.Last() || t.backward())
+}
+
+/*
+Seek moves the iterator to the first key which is greater than or equal to key. The block which may
+contain the key is found by a binary search over the last key of each block in the index.
+ */
+func (t *tableIterator) Seek(key []byte) bool {
+	if !t.loadBlock(t.searchBlock(key)) {
+		return false
+	}
+	return t.counted(t.iter.Seek(key) || t.forward())
+}
+
+/*
+searchBlock returns the first block whose last key is greater than or equal to key, or the last block
+if there is none.
+ */
+func (t *tableIterator) searchBlock(key []byte) int {
+	i := t.r.searchBlock(key)
+	if i == len(t.r.blocks) {
+		i--
+	}
+	return i
+}
+
+/*
+SeekForPrev moves the iterator to the last key which is less than or equal to key.
+ */
+func (t *tableIterator) SeekForPrev(key []byte) bool {
+	i := t.searchBlock(key)
+	if !t.loadBlock(i) {
+		return false
+	}
+	return t.counted(t.iter.SeekForPrev(key) || t.backward())
+}
+
+/*
+Next advances to the next key in the SSTable, loading the next block when the current one is exhausted.
+ */
+func (t *tableIterator) Next() bool {
+	if t.iter == nil {
+		return t.block < 0 && t.First()
+	}
+	return t.counted(t.iter.Next() || t.forward())
+}
+
+/*
+Prev moves to the previous key in the SSTable, loading the previous block when the current one is exhausted.
+ */
+func (t *tableIterator) Prev() bool {
+	if t.iter == nil {
+		if t.block < 0 {
+			return t.Last()
+		}
+		return false
+	}
+	return t.counted(t.iter.Prev() || t.backward())
+}
+
+func (t *tableIterator) forward() bool {
+	for t.err == nil && t.block+1 < len(t.r.blocks) {
+		if t.loadBlock(t.block+1) && t.iter.First() {
+			return true
+		}
+	}
+	if t.iter != nil {
+		t.iter.Close()
+	}
+	return false
+}
+
+func (t *tableIterator) backward() bool {
+	for t.err == nil && t.block > 0 {
+		if t.loadBlock(t.block-1) && t.iter.Last() {
+			return true
+		}
+	}
+	if t.iter != nil {
+		t.iter.invalidate(-1)
+	}
+	return false
+}
+
+func (t *tableIterator) loadBlock(i int) bool {
+	if t.err != nil || i < 0 || i >= len(t.r.blocks) {
+		return false
+	}
+	iter, err := t.r.blockIterator(i)
+	if err != nil {
+		t.err = err
+		return false
+	}
+	t.block = i
+	t.iter = iter
+	return true
+}
+
+/*
+Key returns the current key
+ */
+func (t *tableIterator) Key() []byte {
+	if t.iter == nil {
+		return nil
+	}
+	return t.iter.Key()
+}
+
+/*
+Value returns the value associated with the current key.
+ */
+func (t *tableIterator) Value() []byte {
+	if t.iter == nil {
+		return nil
+	}
+	return t.iter.Value()
+}
+
+/*
+Error returns the error encountered while reading the SSTable.
+ */
+func (t *tableIterator) Error() error {
+	return t.err
+}
+
+/*
+Close closes the iterator.
+ */
+func (t *tableIterator) Close() error {
+	if t.iter != nil {
+		t.iter.Close()
+	}
+	return t.err
+}
+
+/*
+newTableIterator returns an iterator over the SSTable read by r.
+ */
+func newTableIterator(r *Reader) *tableIterator {
+	return &tableIterator{
+		r:     r,
+		block: -1,
+		err:   r.err,
+	}
+}
+
+/*
+sliceIterator iterates over a sorted snapshot of records held in memory, such as the contents of a memtable.
+ */
+type sliceIterator struct {
+	data    []data
+	pos     int
+	started bool
+}
+
+/*
+First moves the iterator to the first record.
+ */
+func (s *sliceIterator) First() bool {
+	return s.moveTo(0)
+}
+
+/*
+Last moves the iterator to the last record.
+ */
+func (s *sliceIterator) Last() bool {
+	return s.moveTo(len(s.data) - 1)
+}
+
+/*
+Seek moves the iterator to the first record whose key is greater than or equal to key.
+ */
+func (s *sliceIterator) Seek(key []byte) bool {
+	return s.moveTo(sort.Search(len(s.data), func(i int) bool {
+		return bytes.Compare(s.data[i].key, key) >= 0
+	}))
+}
+
+/*
+SeekForPrev moves the iterator to the last record whose key is less than or equal to key.
+ */
+func (s *sliceIterator) SeekForPrev(key []byte) bool {
+	return s.moveTo(sort.Search(len(s.data), func(i int) bool {
+		return bytes.Compare(s.data[i].key, key) > 0
+	}) - 1)
+}
+
+/*
+Next advances to the next record.
+ */
+func (s *sliceIterator) Next() bool {
+	if !s.started {
+		return s.First()
+	}
+	return s.moveTo(s.pos + 1)
+}
+
+/*
+Prev moves to the previous record.
+ */
+func (s *sliceIterator) Prev() bool {
+	if !s.started {
+		return s.Last()
+	}
+	return s.moveTo(s.pos - 1)
+}
+
+func (s *sliceIterator) moveTo(pos int) bool {
+	s.started = true
+	if pos < 0 {
+		pos = -1
+	}
+	if pos > len(s.data) {
+		pos = len(s.data)
+	}
+	s.pos = pos
+	return s.valid()
+}
+
+func (s *sliceIterator) valid() bool {
+	return s.pos >= 0 && s.pos < len(s.data)
+}
+
+/*
+Key returns the current key
+ */
+func (s *sliceIterator) Key() []byte {
+	if !s.valid() {
+		return nil
+	}
+	return s.data[s.pos].key
+}
+
+/*
+Value returns the value associated with the current key.
+ */
+func (s *sliceIterator) Value() []byte {
+	if !s.valid() {
+		return nil
+	}
+	return s.data[s.pos].value
+}
+
+/*
+Error always returns nil, since the records are held in memory.
+ */
+func (s *sliceIterator) Error() error {
+	return nil
+}
+
+/*
+Close closes the iterator.
+ */
+func (s *sliceIterator) Close() error {
+	s.data = nil
+	s.pos = 0
+	return nil
+}
+
+func newSliceIterator(d []data) *sliceIterator {
+	return &sliceIterator{
+		data: d,
+		pos:  -1,
+	}
+}
@@ -0,0 +1,137 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package gokvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+
+	"github.com/pkg/errors"
+)
+
+/*
+legacyIndexEntry is an entry of the key index of the SSTables written before the sparse index. The index held
+every key of the SSTable, with the number of bytes of the keys and values before it in the data file.
+ */
+type legacyIndexEntry struct {
+	Key       []byte
+	KeyOffset uint64
+}
+
+/*
+legacyMeta is the contents of the meta file of an SSTable written before SSTables had a footer, which is
+version 0 of the format.
+ */
+type legacyMeta struct {
+	keys     []legacyIndexEntry
+	blocks   []blockInfo
+	lastKeys [][]byte
+}
+
+/*
+decodeLegacyMeta decodes the meta file of an SSTable written before SSTables had a footer. The meta file holds
+the key index encoded with gob, followed by the block info of every block, and ends with four bytes starting
+with the length of the key index as a uvarint. The blocks of these SSTables only hold their entries, as
+
+	uvarint keylen | uvarint vallen | key | value
+
+so the offset of every key in the data file follows from the lengths recorded by the key index, which gives the
+last key of every block. Blocks which hold no entry are left out.
+ */
+func decodeLegacyMeta(meta []byte) (*legacyMeta, error) {
+	if len(meta) < 4 {
+		return nil, errors.New("meta file is too small")
+	}
+	end := len(meta) - 4
+	n, m := binary.Uvarint(meta[end:])
+	if m <= 0 || n > uint64(end) {
+		return nil, errors.New("bad key index length")
+	}
+	lm := &legacyMeta{}
+	if err := gob.NewDecoder(bytes.NewReader(meta[:n])).Decode(&lm.keys); err != nil {
+		return nil, errors.Wrap(err, "failed to decode the key index")
+	}
+	for b := meta[n:end]; len(b) > 0; {
+		bi, k := decodeBlockInfo(b)
+		if k == 0 {
+			return nil, errors.New("bad block info")
+		}
+		if bi.length > 0 {
+			lm.blocks = append(lm.blocks, bi)
+		}
+		b = b[k:]
+	}
+
+	var tmp [binary.MaxVarintLen64]byte
+	offset := uint64(0)
+	for i, e := range lm.keys {
+		if len(lm.lastKeys) == len(lm.blocks) {
+			return nil, errors.Errorf("key %d is past the last block", i)
+		}
+		//the entry is in the block holding its offset, whose last key is that of the previous entry if it does not
+		bi := lm.blocks[len(lm.lastKeys)]
+		for offset >= bi.start+bi.length && i > 0 {
+			lm.lastKeys = append(lm.lastKeys, lm.keys[i-1].Key)
+			if len(lm.lastKeys) == len(lm.blocks) {
+				return nil, errors.Errorf("key %d is past the last block", i)
+			}
+			bi = lm.blocks[len(lm.lastKeys)]
+		}
+		if offset < bi.start {
+			return nil, errors.Errorf("key %d is not in a block", i)
+		}
+		if i+1 < len(lm.keys) {
+			size := lm.keys[i+1].KeyOffset - e.KeyOffset
+			if lm.keys[i+1].KeyOffset < e.KeyOffset || size < uint64(len(e.Key)) {
+				return nil, errors.Errorf("bad offset for key %d", i+1)
+			}
+			offset += uint64(binary.PutUvarint(tmp[:], uint64(len(e.Key))))
+			offset += uint64(binary.PutUvarint(tmp[:], size-uint64(len(e.Key))))
+			offset += size
+		}
+	}
+	if len(lm.keys) > 0 {
+		lm.lastKeys = append(lm.lastKeys, lm.keys[len(lm.keys)-1].Key)
+	}
+	if len(lm.lastKeys) != len(lm.blocks) {
+		return nil, errors.Errorf("expected %d blocks, found %d", len(lm.lastKeys), len(lm.blocks))
+	}
+	return lm, nil
+}
+
+/*
+decodeLegacyBlock returns the entries of a block of an SSTable written before blocks had restart points and
+a trailer as a block built by a blockBuilder, so that it is read like the blocks of the current format.
+ */
+func decodeLegacyBlock(data []byte) (block, error) {
+	b := newBlockBuilder()
+	for len(data) > 0 {
+		keylen, n := binary.Uvarint(data)
+		if n <= 0 {
+			return nil, errors.New("bad entry")
+		}
+		vallen, m := binary.Uvarint(data[n:])
+		if m <= 0 {
+			return nil, errors.New("bad entry")
+		}
+		data = data[n+m:]
+		if keylen > uint64(len(data)) || vallen > uint64(len(data))-keylen {
+			return nil, errors.New("entry out of bounds of the block")
+		}
+		b.add(data[:keylen], data[keylen:keylen+vallen])
+		data = data[keylen+vallen:]
+	}
+	return b.finish(), nil
+}
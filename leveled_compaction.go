@@ -0,0 +1,171 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package gokvstore
+
+import (
+	"bytes"
+	"sort"
+)
+
+const (
+	//maxLevels is the number of levels of leveled compaction, the last level is never compacted further
+	maxLevels = 7
+	//levelSizeMultiplier is how many times more data a level may hold than the level before it
+	levelSizeMultiplier = 10
+	//defaultLevelBaseSize is the number of bytes level 1 may hold if the options do not say
+	defaultLevelBaseSize = 10 << 20
+	//defaultTargetTableSize is the size of the SSTables written by leveled compaction if the options do not say
+	defaultTargetTableSize = 2 << 20
+)
+
+/*
+levelMaxSize returns the number of bytes of SSTables the level, past level 0, may hold before some of them are
+compacted into the next level.
+ */
+func (db *Database) levelMaxSize(level int) uint64 {
+	size := uint64(defaultLevelBaseSize)
+	if db.options.LevelBaseSize > 0 {
+		size = uint64(db.options.LevelBaseSize)
+	}
+	for i := 1; i < level; i++ {
+		size *= levelSizeMultiplier
+	}
+	return size
+}
+
+func (db *Database) targetTableSize() uint64 {
+	if db.options.TargetTableSize > 0 {
+		return uint64(db.options.TargetTableSize)
+	}
+	return defaultTargetTableSize
+}
+
+/*
+levels groups the SSTables, which are ordered from the newest to the oldest, by level. The SSTables of
+level 0 stay ordered from the newest to the oldest, the SSTables of the other levels are ordered by key.
+ */
+func levels(tables []string, meta map[string]tableMeta) [][]string {
+	l := make([][]string, maxLevels)
+	for _, id := range tables {
+		level := meta[id].level
+		if level >= maxLevels {
+			level = maxLevels - 1
+		}
+		l[level] = append(l[level], id)
+	}
+	for _, ids := range l[1:] {
+		sort.SliceStable(ids, func(i, j int) bool {
+			return bytes.Compare(meta[ids[i]].minKey, meta[ids[j]].minKey) < 0
+		})
+	}
+	return l
+}
+
+/*
+keyRange returns the smallest and the largest key of the SSTables.
+ */
+func keyRange(ids []string, meta map[string]tableMeta) (lo, hi []byte) {
+	for _, id := range ids {
+		m := meta[id]
+		if m.empty {
+			continue
+		}
+		if lo == nil || bytes.Compare(m.minKey, lo) < 0 {
+			lo = m.minKey
+		}
+		if hi == nil || bytes.Compare(m.maxKey, hi) > 0 {
+			hi = m.maxKey
+		}
+	}
+	return lo, hi
+}
+
+/*
+overlapping returns the SSTables whose range overlaps the range from lo to hi.
+ */
+func overlapping(ids []string, meta map[string]tableMeta, lo, hi []byte) []string {
+	var found []string
+	if lo == nil {
+		return found
+	}
+	for _, id := range ids {
+		if meta[id].overlaps(lo, hi) {
+			found = append(found, id)
+		}
+	}
+	return found
+}
+
+/*
+pickLeveledCompaction returns the SSTables to compact next, from the newest to the oldest, and the level to
+write the compacted SSTables to, or nil if no level needs to be compacted.
+All the SSTables of level 0 are compacted into level 1, together with the SSTables of level 1 they overlap,
+once there are as many of them as the compaction trigger. Otherwise the first level holding more than its
+size is compacted: one of its SSTables is compacted into the next level, together with the SSTables of the
+next level it overlaps. The SSTables of a level are picked in turn by key, so that the whole key range is
+compacted over time.
+ */
+func (db *Database) pickLeveledCompaction(tables []string, meta map[string]tableMeta) (inputs []string, level int) {
+	l := levels(tables, meta)
+	if len(l[0]) > 0 && len(l[0]) >= db.compactionTrigger() {
+		lo, hi := keyRange(l[0], meta)
+		inputs = append(inputs, l[0]...)
+		return append(inputs, overlapping(l[1], meta, lo, hi)...), 1
+	}
+	for level := 1; level < maxLevels-1; level++ {
+		var size uint64
+		for _, id := range l[level] {
+			size += meta[id].size
+		}
+		if size <= db.levelMaxSize(level) {
+			continue
+		}
+		//the first SSTable past the last key compacted in this level, or the first SSTable of the level
+		picked := l[level][0]
+		for _, id := range l[level] {
+			if bytes.Compare(meta[id].minKey, db.compactPointers[level]) > 0 {
+				picked = id
+				break
+			}
+		}
+		m := meta[picked]
+		db.compactPointers[level] = m.maxKey
+		inputs = append(inputs, picked)
+		return append(inputs, overlapping(l[level+1], meta, m.minKey, m.maxKey)...), level + 1
+	}
+	return nil, 0
+}
+
+/*
+compactLevels compacts the levels of the database which need it, one compaction after the other, until none
+does or stop is closed. Each compaction writes SSTables of the target table size, which do not overlap.
+ */
+func (db *Database) compactLevels(stop <-chan struct{}) {
+	for {
+		tables, meta := db.currentState()
+		inputs, level := db.pickLeveledCompaction(tables, meta)
+		if inputs == nil {
+			return
+		}
+		c := &Compactor{
+			fs:    db.fs,
+			cache: db.cache,
+			stop:  stop,
+		}
+		cs := c.compactTables(inputs, olderTables(tables, inputs, meta), level, db.targetTableSize())
+		if !db.compacted(inputs, cs) {
+			return
+		}
+	}
+}
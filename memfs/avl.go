@@ -211,3 +211,21 @@ func inOrder(n *treeNode) []Comparable {
 	ret = append(ret, inOrder(n.right)...)
 	return ret
 }
+
+func inRange(n *treeNode, from, to Comparable, ret []Comparable) []Comparable {
+	if n == nil {
+		return ret
+	}
+	afterFrom := from == nil || n.data.Compare(from) >= 0
+	beforeTo := to == nil || n.data.Compare(to) <= 0
+	if afterFrom {
+		ret = inRange(n.left, from, to, ret)
+	}
+	if afterFrom && beforeTo {
+		ret = append(ret, n.data)
+	}
+	if beforeTo {
+		ret = inRange(n.right, from, to, ret)
+	}
+	return ret
+}
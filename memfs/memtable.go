@@ -58,3 +58,10 @@ Used when we flush the contents of the Memtable to disk.
 func (memtable *Memtable) InOrder() []Comparable {
 	return inOrder(memtable.Root)
 }
+/*
+Range returns the data between from and to, both inclusive, in order. A nil bound leaves
+that end of the range open.
+ */
+func (memtable *Memtable) Range(from, to Comparable) []Comparable {
+	return inRange(memtable.Root, from, to, []Comparable{})
+}
@@ -13,23 +13,183 @@
 package gokvstore
 
 import (
-	"fmt"
 	"bytes"
+	"container/heap"
+)
+
+const (
+	forward = iota
+	backward
 )
 
 /*
-MergingIterator takes a slice of chunkIterators and navigates over the data in all the chunk iterators.
-Each call to next returns the key and value associated with the smallest key across all the iterators.
-If keys are overlapping, it returns the key and value from the iterator containing the most recent update
-for that key.
+MergingIterator takes a slice of iterators and navigates over the data in all of them, in both directions.
+It is positioned at the smallest key across all the iterators when moving forward, and the largest when
+moving backward. The iterators are kept in a heap ordered by their current key, so moving costs a logarithm
+of the number of iterators.
+Every iterator has a priority, the iterator with the highest priority holds the most recent update of the
+keys it shares with the others. If keys are overlapping, the key and value are returned from the iterator
+with the highest priority, or from the one which comes first in the slice if the priorities are equal. The
+other versions of the key are skipped. Deleted keys are returned with their tombstone value.
  */
 type MergingIterator struct {
-	iters                  []*chunkIterator
-	key, value             []byte
+	iters                  []Iterator
+	priorities             []uint64
+	heap                   mergeHeap
+	current                int
+	//key holds a copy of the current key while the iterators move, since they may reuse the slice
+	key                    []byte
+	dir                    int
+	started                bool
 	closed                 bool
 	numKeysAfterCompaction uint64
 }
 
+/*
+mergeHeap holds the indexes of the iterators which are positioned at a key. The top of the heap is the
+iterator with the smallest key when moving forward, and the largest when moving backward. Of the iterators
+positioned at the same key, the one with the highest priority is on top.
+ */
+type mergeHeap struct {
+	mi    *MergingIterator
+	items []int
+}
+
+func (h *mergeHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *mergeHeap) Less(i, j int) bool {
+	a, b := h.items[i], h.items[j]
+	c := bytes.Compare(h.mi.iters[a].Key(), h.mi.iters[b].Key())
+	if c != 0 {
+		return (c < 0) == (h.mi.dir == forward)
+	}
+	if pa, pb := h.mi.priorities[a], h.mi.priorities[b]; pa != pb {
+		return pa > pb
+	}
+	return a < b
+}
+
+func (h *mergeHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+}
+
+func (h *mergeHeap) Push(x interface{}) {
+	h.items = append(h.items, x.(int))
+}
+
+func (h *mergeHeap) Pop() interface{} {
+	n := len(h.items) - 1
+	x := h.items[n]
+	h.items = h.items[:n]
+	return x
+}
+
+/*
+position builds the heap out of the iterators, after they were all moved, and positions the iterator at the
+top of the heap. valid reports whether each iterator is positioned at a key.
+ */
+func (mi *MergingIterator) position(dir int, valid func(k int, iter Iterator) bool) bool {
+	mi.dir = dir
+	mi.heap.items = mi.heap.items[:0]
+	for k, iter := range mi.iters {
+		if valid(k, iter) {
+			mi.heap.items = append(mi.heap.items, k)
+		}
+	}
+	heap.Init(&mi.heap)
+	return mi.top()
+}
+
+/*
+top positions the iterator at the top of the heap.
+ */
+func (mi *MergingIterator) top() bool {
+	mi.started = true
+	mi.current = -1
+	if mi.heap.Len() == 0 {
+		return false
+	}
+	mi.current = mi.heap.items[0]
+	if mi.dir == forward {
+		mi.numKeysAfterCompaction++
+	}
+	return true
+}
+
+/*
+skip moves every iterator positioned at key past it, in the current direction.
+ */
+func (mi *MergingIterator) skip(key []byte) {
+	for mi.heap.Len() > 0 {
+		k := mi.heap.items[0]
+		iter := mi.iters[k]
+		if !bytes.Equal(iter.Key(), key) {
+			return
+		}
+		var ok bool
+		if mi.dir == forward {
+			ok = iter.Next()
+		} else {
+			ok = iter.Prev()
+		}
+		if ok {
+			heap.Fix(&mi.heap, 0)
+		} else {
+			heap.Pop(&mi.heap)
+		}
+	}
+}
+
+/*
+First moves the iterator to the smallest key across all the iterators.
+ */
+func (mi *MergingIterator) First() bool {
+	if mi.closed {
+		return false
+	}
+	return mi.position(forward, func(k int, iter Iterator) bool {
+		return iter.First()
+	})
+}
+
+/*
+Last moves the iterator to the largest key across all the iterators.
+ */
+func (mi *MergingIterator) Last() bool {
+	if mi.closed {
+		return false
+	}
+	return mi.position(backward, func(k int, iter Iterator) bool {
+		return iter.Last()
+	})
+}
+
+/*
+Seek moves the iterator to the smallest key which is greater than or equal to key.
+ */
+func (mi *MergingIterator) Seek(key []byte) bool {
+	if mi.closed {
+		return false
+	}
+	return mi.position(forward, func(k int, iter Iterator) bool {
+		return iter.Seek(key)
+	})
+}
+
+/*
+SeekForPrev moves the iterator to the largest key which is less than or equal to key.
+ */
+func (mi *MergingIterator) SeekForPrev(key []byte) bool {
+	if mi.closed {
+		return false
+	}
+	return mi.position(backward, func(k int, iter Iterator) bool {
+		return iter.SeekForPrev(key)
+	})
+}
+
 /*
 Next is used to iterate over the keys and values in the merging iterator.
  */
@@ -37,99 +197,127 @@ func (mi *MergingIterator) Next() (hasNext bool) {
 	if mi.closed {
 		return false
 	}
-	if mi.end() {
+	if !mi.started || (mi.current < 0 && mi.dir == backward) {
+		return mi.First()
+	}
+	if mi.current < 0 {
 		return false
 	}
-	mi.numKeysAfterCompaction++
-	k := mi.least()
-	mi.key = mi.iters[k].Key()
-	mi.value = mi.iters[k].Value()
-	mi.iters[k].Next()
-	return true
+	mi.key = append(mi.key[:0], mi.Key()...)
+	key := mi.key
+	if mi.dir == backward {
+		//every iterator is moved to the first key after the current key
+		return mi.position(forward, func(k int, iter Iterator) bool {
+			if !iter.Seek(key) {
+				return false
+			}
+			return !bytes.Equal(iter.Key(), key) || iter.Next()
+		})
+	}
+	mi.skip(key)
+	return mi.top()
+}
+
+/*
+Prev moves the iterator to the previous key.
+ */
+func (mi *MergingIterator) Prev() bool {
+	if mi.closed {
+		return false
+	}
+	if !mi.started || (mi.current < 0 && mi.dir == forward) {
+		return mi.Last()
+	}
+	if mi.current < 0 {
+		return false
+	}
+	mi.key = append(mi.key[:0], mi.Key()...)
+	key := mi.key
+	if mi.dir == forward {
+		//every iterator is moved to the last key before the current key
+		return mi.position(backward, func(k int, iter Iterator) bool {
+			if iter.Seek(key) {
+				return iter.Prev()
+			}
+			return iter.Last()
+		})
+	}
+	mi.skip(key)
+	return mi.top()
 }
 
 /*
 Key returns the current key
  */
 func (mi *MergingIterator) Key() (key []byte) {
-	return mi.key
+	if mi.current < 0 {
+		return nil
+	}
+	return mi.iters[mi.current].Key()
 }
 
 /*
 Value returns the value associated with the current key.
  */
 func (mi *MergingIterator) Value() (value []byte) {
-	return mi.value
+	if mi.current < 0 {
+		return nil
+	}
+	return mi.iters[mi.current].Value()
 }
 
 /*
-Close closes the iterator. Post a call to Close, the iterator cannot be used.
+Error returns the first error reported by any of the merged iterators.
  */
-func (mi *MergingIterator) Close() (err error) {
+func (mi *MergingIterator) Error() error {
 	for _, iter := range mi.iters {
-		err = iter.Close()
-		if err != nil {
-			fmt.Errorf("Failed to close the iterator %v", err)
+		if err := iter.Error(); err != nil {
+			return err
 		}
 	}
-	mi.closed = true
 	return nil
 }
 
-func (mi *MergingIterator) end() bool {
+/*
+Close closes the iterator. Post a call to Close, the iterator cannot be used.
+It returns the first error reported by any of the merged iterators.
+ */
+func (mi *MergingIterator) Close() (err error) {
 	for _, iter := range mi.iters {
-		if !iter.End {
-			return false
+		if cerr := iter.Close(); cerr != nil && err == nil {
+			err = cerr
 		}
 	}
-	return true
+	mi.heap.items = nil
+	mi.current = -1
+	mi.closed = true
+	return err
 }
 
 /*
-least returns the iterator index which has the least key across all the iterators.
+NewMergingIterator returns an instance of a MergingIterator containing all the
+iterators which have been passed in, ordered from the most recent to the oldest.
  */
-func (mi *MergingIterator) least() int {
-	k := 0
-	for j := k + 1; j < len(mi.iters); j++ {
-		if mi.iters[k].End {
-			k++
-			continue
-		}
-		if mi.iters[j].End {
-			continue
-		}
-		if mi.iters[j].start {
-			mi.iters[j].Next()
-		}
-		if mi.iters[k].start {
-			mi.iters[k].Next()
-		}
-		if mi.iters[k].Key() == nil {
-			mi.iters[k].Next()
-		}
-		if mi.iters[j].Key() == nil {
-			mi.iters[j].Next()
-		}
-
-		if bytes.Compare(mi.iters[j].Key(), mi.iters[k].Key()) < 0 {
-			k = j
-		} else if bytes.Equal(mi.iters[j].Key(), mi.iters[k].Key()) {
-			mi.iters[j].Next()
-		}
-
+func NewMergingIterator(iterators []Iterator) *MergingIterator {
+	priorities := make([]uint64, len(iterators))
+	for k := range priorities {
+		priorities[k] = uint64(len(iterators) - k)
 	}
-
-	return k
+	return newMergingIterator(iterators, priorities)
 }
 
 /*
-NewMergingIterator returns an instance of a MergingIterator containing all the
-chunk iterators which have been passed in.
+newMergingIterator returns a MergingIterator over the iterators, each with the priority at the same index.
+The iterator with the highest priority holds the most recent updates.
  */
-func NewMergingIterator(iterators []*chunkIterator) *MergingIterator {
-	iters := make([]*chunkIterator, 0)
+func newMergingIterator(iterators []Iterator, priorities []uint64) *MergingIterator {
+	iters := make([]Iterator, 0)
 	iters = append(iters, iterators...)
-	return &MergingIterator{
-		iters: iters,
+	mi := &MergingIterator{
+		iters:      iters,
+		priorities: append([]uint64(nil), priorities...),
+		current:    -1,
 	}
+	mi.heap.mi = mi
+	return mi
 }
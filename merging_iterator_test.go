@@ -13,15 +13,16 @@
 package gokvstore
 
 import (
-	"encoding/binary"
 	"testing"
 	"bytes"
+	"fmt"
+	"math/rand"
+	"sort"
+	"testing/quick"
 )
 
-var tmp [50]byte
-
 func TestNewMergingIterator_DifferentKeys(t *testing.T) {
-	iters := make([]*chunkIterator, 0)
+	iters := make([]Iterator, 0)
 	data1 := [][]byte{[]byte("4"), []byte("6"), []byte("8")}
 	data2 := [][]byte{[]byte("3"), []byte("5"), []byte("7"), []byte("9")}
 	data3 := [][]byte{[]byte("1"), []byte("12"), []byte("A"), []byte("B"), []byte("C"), []byte("D")}
@@ -35,7 +36,7 @@ func TestNewMergingIterator_DifferentKeys(t *testing.T) {
 	mi := NewMergingIterator(iters)
 	data := make([][]byte, 0)
 	for mi.Next() {
-		data = append(data, mi.Key())
+		data = append(data, append([]byte(nil), mi.Key()...))
 	}
 	i := 0
 	for j := 1; j < len(data); j++ {
@@ -48,7 +49,7 @@ func TestNewMergingIterator_DifferentKeys(t *testing.T) {
 
 
 func TestNewMergingIterator_SameKeys(t *testing.T) {
-	iters := make([]*chunkIterator, 0)
+	iters := make([]Iterator, 0)
 	data1 := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
 	data2 := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
 	data3 := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
@@ -62,7 +63,7 @@ func TestNewMergingIterator_SameKeys(t *testing.T) {
 	mi := NewMergingIterator(iters)
 	data := make([][]byte, 0)
 	for mi.Next() {
-		data = append(data, mi.Key())
+		data = append(data, append([]byte(nil), mi.Key()...))
 	}
 	if len(data) != len(data1) {
 		t.Errorf("merging iterator should have same number of records")
@@ -77,7 +78,7 @@ func TestNewMergingIterator_SameKeys(t *testing.T) {
 
 
 func TestNewMergingIterator_OverlappingKeys(t *testing.T) {
-	iters := make([]*chunkIterator, 0)
+	iters := make([]Iterator, 0)
 	data1 := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
 	data2 := [][]byte{[]byte("1"), []byte("2"), []byte("4")}
 	data3 := [][]byte{[]byte("4"), []byte("5"), []byte("6")}
@@ -91,7 +92,7 @@ func TestNewMergingIterator_OverlappingKeys(t *testing.T) {
 	mi := NewMergingIterator(iters)
 	data := make([][]byte, 0)
 	for mi.Next() {
-		data = append(data,mi.Key())
+		data = append(data, append([]byte(nil), mi.Key()...))
 	}
 	if len(data) != 6 {
 		t.Errorf("merginf iterator should not contain duplicate values")
@@ -105,14 +106,207 @@ func TestNewMergingIterator_OverlappingKeys(t *testing.T) {
 	}
 }
 
+func TestMergingIterator_Reverse(t *testing.T) {
+	iters := make([]Iterator, 0)
+	data1 := [][]byte{[]byte("1"), []byte("2"), []byte("3")}
+	data2 := [][]byte{[]byte("1"), []byte("2"), []byte("4")}
+	data3 := [][]byte{[]byte("4"), []byte("5"), []byte("6")}
+
+	iters = append(iters, NewChunkIterator(createTestData(data1)))
+	iters = append(iters, NewChunkIterator(createTestData(data2)))
+	iters = append(iters, NewChunkIterator(createTestData(data3)))
+	mi := NewMergingIterator(iters)
+	data := make([][]byte, 0)
+	for mi.Prev() {
+		data = append(data, append([]byte(nil), mi.Key()...))
+	}
+	if len(data) != 6 {
+		t.Errorf("merging iterator should not contain duplicate values, got %d keys", len(data))
+	}
+	for j := 1; j < len(data); j++ {
+		if bytes.Compare(data[j-1], data[j]) <= 0 {
+			t.Errorf("keys should be sorted in descending order")
+		}
+	}
+}
+
+func TestMergingIterator_ChangeDirection(t *testing.T) {
+	iters := make([]Iterator, 0)
+	data1 := [][]byte{[]byte("1"), []byte("3"), []byte("5")}
+	data2 := [][]byte{[]byte("2"), []byte("3"), []byte("4")}
+
+	iters = append(iters, NewChunkIterator(createTestData(data1)))
+	iters = append(iters, NewChunkIterator(createTestData(data2)))
+	mi := NewMergingIterator(iters)
+	expected := []string{"1", "2", "3", "2", "1", "2", "3", "4", "3"}
+	moves := []func() bool{mi.Next, mi.Next, mi.Next, mi.Prev, mi.Prev, mi.Next, mi.Next, mi.Next, mi.Prev}
+	for j, move := range moves {
+		if !move() || string(mi.Key()) != expected[j] {
+			t.Errorf("move %d: expected %s, got %s", j, expected[j], mi.Key())
+		}
+	}
+}
+
+func TestMergingIterator_SeekForPrev(t *testing.T) {
+	iters := make([]Iterator, 0)
+	data1 := [][]byte{[]byte("1"), []byte("3"), []byte("5")}
+	data2 := [][]byte{[]byte("2"), []byte("4"), []byte("6")}
+
+	iters = append(iters, NewChunkIterator(createTestData(data1)))
+	iters = append(iters, NewChunkIterator(createTestData(data2)))
+	mi := NewMergingIterator(iters)
+	if !mi.SeekForPrev([]byte("4")) || string(mi.Key()) != "4" {
+		t.Errorf("expected 4, got %s", mi.Key())
+	}
+	if !mi.SeekForPrev([]byte("45")) || string(mi.Key()) != "4" {
+		t.Errorf("expected 4, got %s", mi.Key())
+	}
+	if !mi.Prev() || string(mi.Key()) != "3" {
+		t.Errorf("expected 3, got %s", mi.Key())
+	}
+	if mi.SeekForPrev([]byte("0")) {
+		t.Errorf("expected no key, got %s", mi.Key())
+	}
+	if !mi.Next() || string(mi.Key()) != "1" {
+		t.Errorf("expected 1, got %s", mi.Key())
+	}
+}
+
 func createTestData(data [][]byte) []byte {
-	var res = make([]byte, 0)
-	for _, b := range data {
-		n := binary.PutUvarint(tmp[0:], uint64(len(b)))
-		n += binary.PutUvarint(tmp[n:], uint64(len(b)))
-		res = append(res, tmp[:n]...)
-		res = append(res, b...)
-		res = append(res, b...)
-	}
-	return res
+	b := newBlockBuilder()
+	for _, k := range data {
+		b.add(k, k)
+	}
+	return b.finish()
+}
+
+/*
+mergeModel builds random sources to merge, and the model of their merge: the newest value of every key, which
+is the value of the source with the highest priority, or of the first of them if their priorities are equal.
+It returns the sources, their priorities, the keys of the model in order and the model.
+ */
+func mergeModel(r *rand.Rand) ([]Iterator, []uint64, []string, map[string]string) {
+	n := 1 + r.Intn(6)
+	iters := make([]Iterator, n)
+	priorities := make([]uint64, n)
+	model := make(map[string]string)
+	newest := make(map[string]int)
+	for k := range iters {
+		//few distinct priorities, so that ties are frequent
+		priorities[k] = uint64(r.Intn(3))
+		unique := make(map[string]bool)
+		for i := r.Intn(30); i > 0; i-- {
+			unique[fmt.Sprintf("key%02d", r.Intn(40))] = true
+		}
+		keys := make([]string, 0, len(unique))
+		for key := range unique {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		d := make([]data, 0, len(keys))
+		b := newBlockBuilder()
+		for _, key := range keys {
+			value := fmt.Sprintf("%s/%d", key, k)
+			d = append(d, data{[]byte(key), []byte(value)})
+			b.add([]byte(key), []byte(value))
+			if w, ok := newest[key]; !ok || priorities[k] > priorities[w] {
+				newest[key] = k
+				model[key] = value
+			}
+		}
+		if r.Intn(2) == 0 {
+			iters[k] = newSliceIterator(d)
+		} else {
+			iters[k] = NewChunkIterator(b.finish())
+		}
+	}
+	keys := make([]string, 0, len(model))
+	for key := range model {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return iters, priorities, keys, model
+}
+
+func TestMergingIterator_Model(t *testing.T) {
+	property := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		iters, priorities, keys, model := mergeModel(r)
+		mi := newMergingIterator(iters, priorities)
+		defer mi.Close()
+
+		//pos is the position of the iterator in keys, -1 before the first key and len(keys) after the last
+		pos := 0
+		ok := mi.First()
+		for step := 0; step < 200; step++ {
+			if ok != (pos >= 0 && pos < len(keys)) {
+				t.Logf("seed %d, step %d: expected %v at %d of %v", seed, step, !ok, pos, keys)
+				return false
+			}
+			if ok && (string(mi.Key()) != keys[pos] || string(mi.Value()) != model[keys[pos]]) {
+				t.Logf("seed %d, step %d: expected %s=%s, got %s=%s", seed, step, keys[pos], model[keys[pos]], mi.Key(), mi.Value())
+				return false
+			}
+			target := fmt.Sprintf("key%02d", r.Intn(42))
+			switch r.Intn(6) {
+			case 0:
+				ok = mi.Seek([]byte(target))
+				pos = sort.SearchStrings(keys, target)
+			case 1:
+				ok = mi.SeekForPrev([]byte(target))
+				pos = sort.Search(len(keys), func(i int) bool { return keys[i] > target }) - 1
+			case 2, 3:
+				ok = mi.Next()
+				if pos < len(keys) {
+					pos++
+				}
+			default:
+				ok = mi.Prev()
+				if pos >= 0 {
+					pos--
+				}
+			}
+		}
+		return mi.Error() == nil
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMergingIterator_Priorities(t *testing.T) {
+	property := func(seed int64) bool {
+		r := rand.New(rand.NewSource(seed))
+		iters, priorities, keys, model := mergeModel(r)
+		mi := newMergingIterator(iters, priorities)
+		defer mi.Close()
+		//a full scan forward and backward yields every key once, with its newest value
+		for _, dir := range []int{forward, backward} {
+			got := make([]string, 0)
+			next, first := mi.Next, mi.First
+			if dir == backward {
+				next, first = mi.Prev, mi.Last
+			}
+			for ok := first(); ok; ok = next() {
+				if model[string(mi.Key())] != string(mi.Value()) {
+					t.Logf("seed %d: expected %s for %s, got %s", seed, model[string(mi.Key())], mi.Key(), mi.Value())
+					return false
+				}
+				got = append(got, string(mi.Key()))
+			}
+			if dir == backward {
+				for i, j := 0, len(got)-1; i < j; i, j = i+1, j-1 {
+					got[i], got[j] = got[j], got[i]
+				}
+			}
+			if fmt.Sprint(got) != fmt.Sprint(keys) {
+				t.Logf("seed %d: expected keys %v, got %v", seed, keys, got)
+				return false
+			}
+		}
+		return true
+	}
+	if err := quick.Check(property, &quick.Config{MaxCount: 500}); err != nil {
+		t.Error(err)
+	}
 }
@@ -1,5 +1,10 @@
 package gokvstore
 
+import (
+	"fmt"
+	"time"
+)
+
 
 /*
 Options specify the options a client can use while connecting to the database.
@@ -7,15 +12,151 @@ ReadOnly - is used by a client to connect in a read only mode. No writes are per
 
 UseCompression - specifies whether to use compression. The default compression uses snappy compression.
 
+Compression - selects the codec used to compress the blocks of new SSTables. DefaultCompression uses snappy
+if UseCompression is set and no compression otherwise. Tables written with any codec can be read, whatever
+the codec currently configured.
+
+CompressionLevel - is the zstd compression level, between 1 and 22. Zero selects the zstd default level. It
+is ignored by the other codecs.
+
 SyncWrite - determines whether writes are synchronously written to the write ahead log.
+
+MaxOpenFiles - is the number of files the database may keep open. Most of them hold the SSTables which
+are cached open for reads, the least recently used are closed when the limit is reached. Zero selects a
+default of 1000.
+
+BlockCacheSize - is the number of bytes of decompressed SSTable blocks kept in memory for reads. Zero selects
+a default of 8MB, a negative size disables the block cache.
+
+SkipChecksumVerification - skips verifying the checksums of SSTable blocks and meta files as they are read.
+Damaged data which cannot be decoded is still reported as an *ErrCorruption.
+
+SingleFileTables - writes each new SSTable as a single file, holding its data blocks, filter, index and
+properties, instead of a data, meta and filter file. The file is written under a temporary name and renamed
+once complete, so a crash cannot leave an SSTable half written. SSTables of both layouts are read whatever
+this option. SSTables written by compaction are single files whatever this option.
+
+CompactionTrigger - is the number of SSTables from which the database compacts them in the background. Zero
+selects a default of 4, a negative trigger disables background compaction. Read only databases are not compacted.
+
+MinCompactionThreshold - is the smallest number of SSTables of similar size which size tiered compaction
+compacts together. Values below 2 select 2.
+
+MaxCompactionThreshold - is the largest number of SSTables which size tiered compaction compacts together.
+Zero selects a default of 32.
+
+BucketLow and BucketHigh - bound the size of the SSTables which size tiered compaction considers similar. An
+SSTable is compacted with the SSTables written just before or after it if its size is between BucketLow and
+BucketHigh times their average size. Zero selects defaults of 0.5 and 1.5. SSTables smaller than 1MB are all
+considered similar.
+
+TombstoneGracePeriod - is how long deleted keys are kept once deleted. Compaction drops a deleted key, together
+with its older values, once the grace period has passed since the key was deleted, unless an
+SSTable which is not compacted may still hold an older value of the key. Zero drops deleted keys as soon as
+possible, a negative grace period keeps them forever.
+
+CompactionStyle - selects how SSTables are compacted, SizeTieredCompaction by default. With LeveledCompaction the
+trigger is the number of SSTables in level 0.
+
+LevelBaseSize - is the number of bytes of SSTables level 1 may hold with leveled compaction, each next level may
+hold ten times more. Zero selects a default of 10MB.
+
+TargetTableSize - is the size from which leveled compaction starts a new SSTable. Zero selects a default of 2MB.
  */
 type Options struct {
 	ReadOnly bool
 
 	UseCompression bool
 
+	Compression Compression
+
+	CompressionLevel int
+
 	SyncWrite bool
+
+	MaxOpenFiles int
+
+	BlockCacheSize int
+
+	SkipChecksumVerification bool
+
+	SingleFileTables bool
+
+	CompactionTrigger int
+
+	MinCompactionThreshold int
+
+	MaxCompactionThreshold int
+
+	BucketLow float64
+
+	BucketHigh float64
+
+	TombstoneGracePeriod time.Duration
+
+	CompactionStyle CompactionStyle
+
+	LevelBaseSize int
+
+	TargetTableSize int
+}
+/*
+Compression is the codec used to compress the blocks of an SSTable.
+ */
+type Compression int
+
+const (
+	DefaultCompression Compression = iota
+	NoCompression
+	SnappyCompression
+	ZstdCompression
+	LZ4Compression
+)
+
+func (c Compression) String() string {
+	switch c {
+	case DefaultCompression:
+		return "default"
+	case NoCompression:
+		return "none"
+	case SnappyCompression:
+		return "snappy"
+	case ZstdCompression:
+		return "zstd"
+	case LZ4Compression:
+		return "lz4"
+	}
+	return fmt.Sprintf("compression(%d)", int(c))
+}
+
+/*
+CompactionStyle selects how the database compacts its SSTables.
+
+SizeTieredCompaction - merges SSTables written one after the other into a single SSTable. SSTables may
+overlap, so a read may look into all of them.
+
+LeveledCompaction - keeps the SSTables in levels. SSTables flushed from memory go to level 0 and may overlap,
+the SSTables of each next level do not overlap and hold ten times more data than the previous level. A read
+looks into at most one SSTable of each level past level 0.
+ */
+type CompactionStyle int
+
+const (
+	SizeTieredCompaction CompactionStyle = iota
+	LeveledCompaction
+)
+
+//compression resolves DefaultCompression to the codec implied by UseCompression.
+func (o *Options) compression() Compression {
+	if o.Compression != DefaultCompression {
+		return o.Compression
+	}
+	if o.UseCompression {
+		return SnappyCompression
+	}
+	return NoCompression
 }
+
 /*
 The default options if the client does not specify any.
  */
@@ -24,3 +165,12 @@ var DefaultOptions = &Options{
 	UseCompression: true,
 	SyncWrite:      false,
 }
+
+/*
+WriteOptions specify the options for a call to Database.Write.
+Sync - determines whether the write ahead log is synced before Write returns. Writes are always
+synced if the database was opened with SyncWrite.
+ */
+type WriteOptions struct {
+	Sync bool
+}
@@ -0,0 +1,231 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package gokvstore
+
+import (
+	"encoding/binary"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+//the names of the properties stored in the properties block of an SSTable
+const (
+	propNumEntries    = "num.entries"
+	propNumTombstones = "num.tombstones"
+	propMinKey        = "min.key"
+	propMaxKey        = "max.key"
+	propRawSize       = "raw.size"
+	propDataSize      = "data.size"
+	propCreationTime  = "creation.time"
+	propCompression   = "compression"
+	propSequence      = "sequence"
+	propInputs        = "compaction.inputs"
+	propLevel         = "level"
+	propDeletionTime  = "deletion.time"
+)
+
+/*
+TableProperties describes the contents of an SSTable. The properties are computed by the Writer and
+stored in the properties block of the meta file.
+
+NumEntries - is the number of keys stored in the SSTable, including deleted keys.
+
+NumTombstones - is the number of deleted keys stored in the SSTable.
+
+MinKey - is the smallest key of the SSTable, or nil if the SSTable is empty.
+
+MaxKey - is the largest key of the SSTable, or nil if the SSTable is empty.
+
+RawSize - is the number of bytes of the blocks of the SSTable before they are compressed.
+
+DataSize - is the number of bytes of the blocks as written to the data file.
+
+CreationTime - is the time at which the SSTable was written.
+
+Compression - is the codec the blocks were compressed with. Blocks which do not compress well are stored as is.
+
+Sequence - orders the SSTables of a database, an SSTable with a larger sequence holds newer data. An SSTable
+written by compaction has the largest sequence of the SSTables it was compacted from.
+
+CompactionInputs - is the names of the SSTables this SSTable was compacted from, or nil if it was not written by compaction.
+
+Level - is the level of the SSTable with leveled compaction. SSTables written by a flush, or by size tiered
+compaction, are in level 0.
+
+DeletionTime - is the latest time at which one of the deleted keys of the SSTable was deleted, or the zero time
+if it holds no deleted keys. An SSTable written by compaction keeps the deletion time of the deleted keys it was
+compacted from, so that they are dropped once the grace period has passed since they were deleted.
+ */
+type TableProperties struct {
+	NumEntries    uint64
+	NumTombstones uint64
+	MinKey        []byte
+	MaxKey        []byte
+	RawSize       uint64
+	DataSize      uint64
+	CreationTime  time.Time
+	Compression   Compression
+	Sequence      uint64
+	CompactionInputs []string
+	Level         int
+	DeletionTime  time.Time
+}
+
+func appendProperty(dst []byte, name string, value []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(name)))
+	dst = append(dst, tmp[:n]...)
+	dst = append(dst, name...)
+	n = binary.PutUvarint(tmp[:], uint64(len(value)))
+	dst = append(dst, tmp[:n]...)
+	return append(dst, value...)
+}
+
+func appendUintProperty(dst []byte, name string, value uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], value)
+	return appendProperty(dst, name, tmp[:n])
+}
+
+/*
+encode returns the properties block. Each property is stored as its name and its value, both preceded
+by their length as a uvarint. Numbers are stored as uvarints.
+ */
+func (p *TableProperties) encode() []byte {
+	b := make([]byte, 0, 128+len(p.MinKey)+len(p.MaxKey))
+	b = appendUintProperty(b, propNumEntries, p.NumEntries)
+	b = appendUintProperty(b, propNumTombstones, p.NumTombstones)
+	b = appendProperty(b, propMinKey, p.MinKey)
+	b = appendProperty(b, propMaxKey, p.MaxKey)
+	b = appendUintProperty(b, propRawSize, p.RawSize)
+	b = appendUintProperty(b, propDataSize, p.DataSize)
+	b = appendUintProperty(b, propCreationTime, uint64(p.CreationTime.UnixNano()))
+	b = appendUintProperty(b, propCompression, uint64(p.Compression))
+	b = appendUintProperty(b, propSequence, p.Sequence)
+	b = appendUintProperty(b, propLevel, uint64(p.Level))
+	if !p.DeletionTime.IsZero() {
+		b = appendUintProperty(b, propDeletionTime, uint64(p.DeletionTime.UnixNano()))
+	}
+	if p.CompactionInputs != nil {
+		//the names are stored one after the other, each preceded by its length as a uvarint
+		var inputs []byte
+		var tmp [binary.MaxVarintLen64]byte
+		for _, id := range p.CompactionInputs {
+			n := binary.PutUvarint(tmp[:], uint64(len(id)))
+			inputs = append(append(inputs, tmp[:n]...), id...)
+		}
+		b = appendProperty(b, propInputs, inputs)
+	}
+	return b
+}
+
+/*
+decodeProperties decodes a properties block. Properties this version does not know are skipped, so that
+new properties can be added without changing the format version.
+ */
+func decodeProperties(b []byte) (TableProperties, error) {
+	var p TableProperties
+	for i := 0; i < len(b); {
+		namelen, n := binary.Uvarint(b[i:])
+		if n <= 0 || namelen > uint64(len(b)-i-n) {
+			return p, errors.Errorf("bad property name at %d", i)
+		}
+		name := string(b[i+n : i+n+int(namelen)])
+		j := i + n + int(namelen)
+		vallen, m := binary.Uvarint(b[j:])
+		if m <= 0 || vallen > uint64(len(b)-j-m) {
+			return p, errors.Errorf("bad value for property %s", name)
+		}
+		value := b[j+m : j+m+int(vallen)]
+		i = j + m + int(vallen)
+
+		var num uint64
+		switch name {
+		case propNumEntries, propNumTombstones, propRawSize, propDataSize, propCreationTime, propCompression, propSequence, propLevel, propDeletionTime:
+			var k int
+			if num, k = binary.Uvarint(value); k != len(value) {
+				return p, errors.Errorf("bad value for property %s", name)
+			}
+		}
+		switch name {
+		case propNumEntries:
+			p.NumEntries = num
+		case propNumTombstones:
+			p.NumTombstones = num
+		case propMinKey:
+			p.MinKey = append([]byte(nil), value...)
+		case propMaxKey:
+			p.MaxKey = append([]byte(nil), value...)
+		case propRawSize:
+			p.RawSize = num
+		case propDataSize:
+			p.DataSize = num
+		case propCreationTime:
+			p.CreationTime = time.Unix(0, int64(num))
+		case propCompression:
+			p.Compression = Compression(num)
+		case propSequence:
+			p.Sequence = num
+		case propLevel:
+			p.Level = int(num)
+		case propDeletionTime:
+			p.DeletionTime = time.Unix(0, int64(num))
+		case propInputs:
+			p.CompactionInputs = make([]string, 0)
+			for k := 0; k < len(value); {
+				idlen, n := binary.Uvarint(value[k:])
+				if n <= 0 || idlen > uint64(len(value)-k-n) {
+					return p, errors.Errorf("bad value for property %s", name)
+				}
+				p.CompactionInputs = append(p.CompactionInputs, string(value[k+n:k+n+int(idlen)]))
+				k += n + int(idlen)
+			}
+		}
+	}
+	return p, nil
+}
+
+/*
+deletionTime returns the latest time at which the deleted keys of the SSTable were deleted. The deleted keys of
+an SSTable written before deletion times were recorded were deleted before it was created.
+ */
+func (p *TableProperties) deletionTime() time.Time {
+	switch {
+	case !p.DeletionTime.IsZero():
+		return p.DeletionTime
+	case !p.CreationTime.IsZero():
+		return p.CreationTime
+	}
+	return time.Unix(0, 0)
+}
+
+/*
+TableProperties returns the properties of every SSTable of the database, by the name of the SSTable.
+ */
+func (db *Database) TableProperties() (map[string]TableProperties, error) {
+	db.readers.RLock()
+	defer db.readers.RUnlock()
+	props := make(map[string]TableProperties)
+	tables, _ := db.currentState()
+	for _, id := range tables {
+		t, err := db.cache.get(id)
+		if err != nil {
+			return nil, err
+		}
+		props[id] = t.reader.Properties()
+		db.cache.release(t)
+	}
+	return props, nil
+}
@@ -13,275 +13,427 @@
 package gokvstore
 
 import (
+	"bufio"
 	"encoding/binary"
 	"os"
 	"bytes"
 	"sort"
-	"syscall"
 	"github.com/pkg/errors"
-	"encoding/gob"
 	"fmt"
-	"io"
+	"hash/crc32"
+	"syscall"
+	"github.com/tylertreat/BoomFilters"
 )
 
 func decodeBlockInfo(src []byte) (blockInfo, int) {
 	offset, n := binary.Uvarint(src)
+	if n <= 0 {
+		return blockInfo{}, 0
+	}
 	length, m := binary.Uvarint(src[n:])
-	if n == 0 || m == 0 {
+	if m <= 0 {
 		return blockInfo{}, 0
 	}
 	return blockInfo{offset, length}, n + m
 }
 
+//ErrReaderClosed is returned when reading blocks from a reader which has been closed.
+var ErrReaderClosed = errors.New("reader is closed")
+
+//ErrUnknownFormatVersion is returned when reading an SSTable written in a format this version does not know.
+var ErrUnknownFormatVersion = errors.New("unknown sstable format version")
+
+/*
+ErrCorruption is returned when the contents of an SSTable do not match their checksum or cannot be decoded.
+File is the name of the file holding the damaged data and Offset is where the damaged block or section starts.
+ */
+type ErrCorruption struct {
+	File   string
+	Offset int64
+	Err    error
+}
+
+func (e *ErrCorruption) Error() string {
+	return fmt.Sprintf("corruption in %s at offset %d: %v", e.File, e.Offset, e.Err)
+}
+
+/*
+Unwrap returns the reason for the corruption.
+ */
+func (e *ErrCorruption) Unwrap() error {
+	return e.Err
+}
+
 type block []byte
 
 /*
 Reader is used to read the SSTable and retrive the values associated with a key. A reader understands the internal
 structure of a SSTable and loads the data and the meta files. It maintains the key index, containing the key and
-its offset in-memory. It determines which block the key resides in and loads that block using the key offset.
-For range queries, it uses the offset of the start and end keys to load the data.
+the block it belongs to in-memory. It determines which block the key resides in by a binary search over the last
+key of each block and loads that block. Range queries load one block at a time, starting with the block of the start key.
+The data file is mapped in memory as a whole, and blocks are read from the mapping. A reader owns the files of
+its SSTable, and must be closed to release the mapping and the files once it is no longer used.
  */
 type Reader struct {
+	data       []byte
 	datafile   *os.File
 	metafile   *os.File
 	filterfile *os.File
 	err        error
-	keyIndex   []index
+	lastKeys   [][]byte
 	blocks     []blockInfo
-	compress   bool
+	props      TableProperties
+	//filter holds the filter block of a single file SSTable until it is read, at filterOffset in the file
+	filter       []byte
+	filterOffset uint64
+	verify     bool
+	//legacy is set for the SSTables of version 0 of the format, whose blocks have no restart points and no trailer
+	legacy     bool
+	//id and cache are set when the blocks read are shared through a block cache
+	id         string
+	cache      *blockCache
 }
 
-func (r *Reader) seek(key []byte, i int) *chunkIterator {
-	var offset uint64
-	var bi blockInfo
-	if i < len(r.keyIndex) && i > 0 {
-		offset = r.keyIndex[i].KeyOffset + uint64(2*i)
-		for _, block := range r.blocks {
-			if block.start < offset && offset <= (block.start+block.length) {
-				bi = block
-				break
-			}
-		}
-	} else if i == len(r.keyIndex) {
-		bi = r.blocks[len(r.blocks)-1]
-		offset = bi.start + bi.length
-	}
-	data, err := r.readBlock(bi)
-	if err != nil {
-		r.err = err
-	}
-	iter := NewChunkIterator(data[0 : offset-bi.start])
-	for iter.Next() && bytes.Compare(iter.Key(), key) < 0 {
+/*
+Range is used for range queries. It returns a Cursor over the keys of the SSTable from the start key
+to the end key, both inclusive, skipping deleted keys. The start and end keys need not exist in the
+SSTable. The cursor reads one block at a time as it advances. The reader must not be closed while the cursor is in use.
+ */
+func (r *Reader) Range(startkey, endkey []byte) (cursor *Cursor, err error) {
+	if r.err != nil {
+		return nil, r.err
 	}
+	return NewCursor(newDBIterator(newTableIterator(r), startkey, successor(endkey), nil)), nil
+}
 
-	if iter.err != nil {
-		r.err = iter.err
-	}
-	iter.start = !iter.End
-	return iter
+/*
+searchBlock returns the first block whose last key is greater than or equal to key, which is the only
+block which may hold key, or the number of blocks if key is greater than every key of the SSTable.
+ */
+func (r *Reader) searchBlock(key []byte) int {
+	return sort.Search(len(r.lastKeys), func(i int) bool {
+		return bytes.Compare(r.lastKeys[i], key) >= 0
+	})
 }
 
 /*
-Range is used for range queries. It loads the data from the SSTable starting at the start key offset,
-till the end key offset. It returns a Cursor which is used to traverse over the range. The start and end keys
-must reside in the same SSTable.
+Get returns the value associated with a particular key. It uses the index to find the block within the
+SSTable in which the key may reside, and searches that block for the key to return the value.
+ErrKeyNotFound is returned if the SSTable does not contain the key.
  */
-func (r *Reader) Range(startkey, endkey []byte) (cursor *Cursor, err error) {
+func (r *Reader) Get(key []byte) ([]byte, error) {
 	if r.err != nil {
 		return nil, r.err
 	}
-
-	d := make([]data, 0)
-	idx1, found := r.hasKey(startkey)
-	if !found {
-		return nil, ErrKeyNotFound
-	}
-	keyOffset1 := r.keyIndex[idx1-1].KeyOffset + uint64(2*(idx1-1))
-	idx2, found := r.hasKey(endkey)
-	if !found {
+	i := r.searchBlock(key)
+	if i == len(r.blocks) {
 		return nil, ErrKeyNotFound
 	}
-	keyOffset2 := r.keyIndex[idx2].KeyOffset + uint64(2*idx2)
-	bi := blockInfo{
-		start:  uint64(keyOffset1),
-		length: keyOffset2 - keyOffset1,
-	}
-	blkData, err := r.readBlock(bi)
+	iter, err := r.blockIterator(i)
 	if err != nil {
-		r.err = err
+		return nil, err
 	}
-	iter := NewChunkIterator(blkData)
-	for iter.Next() {
-		kvpair := data{iter.Key(), iter.Value()}
-		d = append(d, kvpair)
+	if iter.Seek(key) && bytes.Equal(iter.Key(), key) {
+		//the value belongs to a block which may be shared through the block cache
+		return append([]byte(nil), iter.Value()...), nil
 	}
-	return NewCursor(d), nil
+	return nil, ErrKeyNotFound
 }
 
-func (r *Reader) hasKey(key []byte) (int, bool) {
-	i := sort.Search(len(r.keyIndex), func(i int) bool {
-		return bytes.Compare(r.keyIndex[i].Key, key) > 0
-	})
-	if i > len(r.keyIndex) {
-		return -1, false
-	}
-	if bytes.Equal(r.keyIndex[i-1].Key, key) {
-		return i, true
-	}
-	return -1, false
+/*
+Properties returns the properties of the SSTable.
+ */
+func (r *Reader) Properties() TableProperties {
+	return r.props
 }
 
 /*
-Get returns the value associated with a particular key. It finds the block within the SSTable in which
-the key resides and seeks to the offset of the key to return the value.
+readFilter reads the bloom filter of the SSTable from its filter file, or from the filter block of a single
+file SSTable.
  */
-func (r *Reader) Get(key []byte) ([]byte, bool) {
-	if r.err != nil {
-		return nil, false
-	}
-	var value []byte
-	idx, found := r.hasKey(key)
-	if !found {
-		return nil, false
-	}
-	iter := r.seek(key, idx)
-	for iter.Next() && iter.err == nil {
-		k := iter.Key()
-		if bytes.Equal(k, key) {
-			value = iter.Value()
-			break
+func (r *Reader) readFilter() (*boom.ScalableBloomFilter, error) {
+	filter := boom.NewDefaultScalableBloomFilter(filterFalsePositiveRate)
+	if r.filterfile == nil {
+		if _, err := filter.ReadFrom(bytes.NewReader(r.filter)); err != nil {
+			return nil, r.corruption(r.datafile, r.filterOffset, errors.Wrap(err, "failed to read the filter"))
 		}
+		return filter, nil
 	}
-	if value == nil && iter.err != nil {
-		return nil, false
+	if _, err := filter.ReadFrom(bufio.NewReader(r.filterfile)); err != nil {
+		return nil, r.corruption(r.filterfile, 0, errors.Wrap(err, "failed to read the filter"))
 	}
+	return filter, nil
+}
 
-	return value, true
+func (r *Reader) corruption(file *os.File, offset uint64, err error) error {
+	return &ErrCorruption{File: file.Name(), Offset: int64(offset), Err: err}
 }
 
+/*
+readBlock returns the decompressed contents of a block. Blocks are looked up in the block cache first, if
+the reader has one, and added to it once read and checked.
+ */
 func (r *Reader) readBlock(bi blockInfo) (block, error) {
+	if bi.length == 0 {
+		return block{}, nil
+	}
+	if r.cache != nil {
+		if b, ok := r.cache.get(blockKey{r.id, bi.start}); ok {
+			return b, nil
+		}
+	}
+	if r.data == nil {
+		return nil, ErrReaderClosed
+	}
 
-	//b := make([]byte, bi.length)
-	data, err := syscall.Mmap(int(r.datafile.Fd()), int64(bi.start), int(bi.length), syscall.PROT_READ, syscall.MAP_PRIVATE)
+	data := r.data[bi.start : bi.start+bi.length]
+	var b block
+	var err error
+	if r.legacy {
+		b, err = decodeLegacyBlock(data)
+	} else {
+		b, err = decodeBlock(data, r.verify)
+	}
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to mmap the datafile for reading")
+		return nil, r.corruption(r.datafile, bi.start, err)
 	}
-
-	//if r.compress {
-	//	b, err = snappy.Decode(nil, data)
-	//	if err != nil {
-	//		return nil, errors.Wrap(err, "failed to uncompress data")
-	//
-	//	}
-	//}
-	//fmt.Printf("decompressed data %s\n,",string(b))
-	return data, nil
+	//an uncompressed block is a slice of the mapping, it is copied so that it outlives the reader
+	if !r.legacy && data[len(data)-blockTrailerSize] == noCompressionBlock {
+		b = append(block(nil), b...)
+	}
+	//the entries are checked once, so that the iterators of a cached block can decode them lazily
+	if err := NewChunkIterator(b).check(); err != nil {
+		return nil, r.corruption(r.datafile, bi.start, err)
+	}
+	if r.cache != nil {
+		r.cache.put(blockKey{r.id, bi.start}, b)
+	}
+	return b, nil
 }
 
-func (r *Reader) readIndex(offset uint64) ([]index, error) {
-	data, err := syscall.Mmap(int(r.metafile.Fd()), 0, int(offset), syscall.PROT_READ, syscall.MAP_PRIVATE)
+/*
+blockIterator returns an iterator over the i-th block of the SSTable.
+ */
+func (r *Reader) blockIterator(i int) (*chunkIterator, error) {
+	data, err := r.readBlock(r.blocks[i])
 	if err != nil {
-		return nil, errors.Wrap(err, "failed to mmap the metafile for reading")
-	}
-	var buf bytes.Buffer
-	if _, err := buf.Write(data); err != nil {
 		return nil, err
 	}
-	decoder := gob.NewDecoder(&buf)
-	var keyIndex []index
+	iter := NewChunkIterator(data)
+	if iter.err != nil {
+		return nil, r.corruption(r.datafile, r.blocks[i].start, iter.err)
+	}
+	return iter, nil
+}
 
-	if err := decoder.Decode(&keyIndex); err != nil {
-		return nil, err
+/*
+Close releases the mapping of the data file and closes the files of the SSTable. Blocks and values read
+from the reader remain valid after it is closed.
+ */
+func (r *Reader) Close() (err error) {
+	if len(r.data) > 0 {
+		err = syscall.Munmap(r.data)
+	}
+	r.data = nil
+	for _, f := range []**os.File{&r.datafile, &r.metafile, &r.filterfile} {
+		if *f == nil {
+			continue
+		}
+		if cerr := (*f).Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		*f = nil
+	}
+	return err
+}
 
+/*
+readIndex decodes the sparse index of the SSTable, which holds the last key and the block info of every block.
+The index is at offset in file.
+ */
+func (r *Reader) readIndex(file *os.File, offset uint64, b []byte, count uint64, dataSize int64) error {
+	r.lastKeys = make([][]byte, 0, count)
+	r.blocks = make([]blockInfo, 0, count)
+	for i := 0; i < len(b); {
+		keylen, n := binary.Uvarint(b[i:])
+		if n <= 0 || keylen > uint64(len(b)-i-n) {
+			return r.corruption(file, offset+uint64(i), errors.New("bad index entry"))
+		}
+		lastKey := b[i+n : i+n+int(keylen)]
+		bi, m := decodeBlockInfo(b[i+n+int(keylen):])
+		if m == 0 {
+			return r.corruption(file, offset+uint64(i), errors.New("bad block info"))
+		}
+		if bi.start > uint64(dataSize) || bi.length > uint64(dataSize)-bi.start || bi.length < blockTrailerSize {
+			return r.corruption(file, offset+uint64(i), errors.New("block info out of bounds of the datafile"))
+		}
+		r.lastKeys = append(r.lastKeys, lastKey)
+		r.blocks = append(r.blocks, bi)
+		i += n + int(keylen) + m
+	}
+	if uint64(len(r.blocks)) != count {
+		return r.corruption(file, offset, errors.Errorf("expected %d index entries, found %d", count, len(r.blocks)))
 	}
-	return keyIndex, nil
+	return nil
 }
 
-func (r *Reader) readBlockInfo(offset uint64, bufLen int64) ([]blockInfo, error) {
-	b := make([]byte, bufLen)
+/*
+readMeta reads the metadata of the SSTable from the file holding its footer, and decodes the footer, the
+properties and the sparse index. It returns the size of the data blocks, which is dataSize unless the
+metadata follows the data blocks in the data file.
+ */
+func (r *Reader) readMeta(file *os.File, size int64, dataSize int64) (int64, error) {
+	if size < footerTrailerSize {
+		return 0, r.corruption(file, 0, errors.New("file is too small for its footer"))
+	}
+	tail := make([]byte, footerSize)
+	if size < int64(len(tail)) {
+		tail = tail[:size]
+	}
+	if _, err := file.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return 0, fmt.Errorf("invalid table, could not read footer: %v", err)
+	}
+	f, err := decodeFooter(tail)
+	if err == errNoFooter && file == r.metafile {
+		//the meta file may be one of an SSTable written before SSTables had a footer
+		if r.readLegacyMeta(size, dataSize) == nil {
+			return dataSize, nil
+		}
+	}
+	if err != nil {
+		return 0, r.corruption(file, uint64(size-footerTrailerSize), err)
+	}
+	end := uint64(size) - uint64(f.size())
+	if f.metaOffset > end {
+		return 0, r.corruption(file, end, errors.New("bad footer"))
+	}
+	meta := make([]byte, uint64(size)-f.metaOffset)
+	if _, err := file.ReadAt(meta, int64(f.metaOffset)); err != nil {
+		return 0, fmt.Errorf("invalid table, could not read metafile: %v", err)
+	}
+	if r.verify && crc32.Checksum(meta[:len(meta)-12], crcTable) != f.checksum {
+		return 0, r.corruption(file, f.metaOffset, errors.New("metafile checksum mismatch"))
+	}
+	indexOffset := f.metaOffset + f.filterLength
+	if indexOffset < f.metaOffset || indexOffset > f.propsOffset || f.propsOffset > end {
+		return 0, r.corruption(file, end, errors.New("bad footer"))
+	}
+	if r.props, err = decodeProperties(meta[f.propsOffset-f.metaOffset : end-f.metaOffset]); err != nil {
+		return 0, r.corruption(file, f.propsOffset, err)
+	}
+	if file == r.datafile {
+		//the data blocks of a single file SSTable are followed by its metadata
+		dataSize = int64(f.metaOffset)
+		r.filter, r.filterOffset = meta[:f.filterLength], f.metaOffset
+	}
+	index := meta[indexOffset-f.metaOffset : f.propsOffset-f.metaOffset]
+	return dataSize, r.readIndex(file, indexOffset, index, uint64(f.numBlocks), dataSize)
+}
 
-	if _, err := r.metafile.ReadAt(b, int64(offset)); err != nil {
-		return nil, err
+/*
+readLegacyMeta reads the meta file of an SSTable of version 0 of the format, which has no footer, no properties
+and no checksums. The properties of the SSTable are those told by its key index.
+ */
+func (r *Reader) readLegacyMeta(size int64, dataSize int64) error {
+	meta := make([]byte, size)
+	if _, err := r.metafile.ReadAt(meta, 0); err != nil {
+		return err
+	}
+	lm, err := decodeLegacyMeta(meta)
+	if err != nil {
+		return err
 	}
-	blocks := make([]blockInfo, 0)
-	i, _ := 0, 1
-	for {
-		bi, n := decodeBlockInfo(b[i:])
-		if bi.length == 0 {
-			break
+	for _, bi := range lm.blocks {
+		if bi.start > uint64(dataSize) || bi.length > uint64(dataSize)-bi.start {
+			return errors.New("block info out of bounds of the datafile")
 		}
-		i += n
-		blocks = append(blocks, bi)
 	}
-	return blocks, nil
-
+	r.legacy = true
+	r.blocks, r.lastKeys = lm.blocks, lm.lastKeys
+	r.props = TableProperties{
+		NumEntries:  uint64(len(lm.keys)),
+		RawSize:     uint64(dataSize),
+		DataSize:    uint64(dataSize),
+		Compression: NoCompression,
+	}
+	if len(lm.keys) > 0 {
+		r.props.MinKey = lm.keys[0].Key
+		r.props.MaxKey = lm.keys[len(lm.keys)-1].Key
+	}
+	return nil
 }
 
 /*
-NewReader returns a Reader for an SSTable. If compress is true, it uncompresses the data post reading it.
-The returned reader is initialized and ready to use i.e, the meta file containing the index and the block
-information for all the blocks in the SSTable, is loaded in memory during this call. Calls to Get is where the data file is read based on the offset of
-the key in the SSTable.
+NewReader returns a Reader for an SSTable which verifies checksums. Compressed blocks are uncompressed
+whatever the value of compress, as each block records how it was written.
  */
 func NewReader(sst *SSTable, compress bool) *Reader {
-	keyIndex := make([]index, 0)
-	blocks := make([]blockInfo, 0)
+	return NewReaderWithOptions(sst, &Options{UseCompression: compress})
+}
 
+/*
+NewReaderWithOptions returns a Reader for an SSTable. Each block is uncompressed post reading it if its trailer says it
+was compressed, whatever the compression selected by the options.
+The returned reader is initialized and ready to use i.e, the meta file containing the sparse index of the
+blocks in the SSTable and the properties of the SSTable, is loaded in memory during this call. The meta file
+must end with the magic number and a format version this version can read, unless it is the meta file of an
+SSTable written before SSTables had a footer, which is read as version 0 of the format. Calls to Get is where the data
+file is read based on the offset of the key in the SSTable.
+Single file SSTables are read the same way, from the metadata following their data blocks.
+The checksums of the meta file and of every block are verified as they are read, unless the options skip
+checksum verification. Damaged data is reported as an *ErrCorruption.
+The reader takes over the files of the SSTable, which are closed by Reader.Close, even if the reader
+reports an error.
+ */
+func NewReaderWithOptions(sst *SSTable, options *Options) *Reader {
 	r := &Reader{
-		keyIndex:   keyIndex,
-		blocks:     blocks,
 		datafile:   sst.datafile,
 		metafile:   sst.metafile,
 		filterfile: sst.filterfile,
-		compress:   compress,
+		verify:     !options.SkipChecksumVerification,
 	}
 
 	if r.datafile == nil {
 		r.err = errors.New("nil datafile")
 		panic(r.err)
 	}
-	stat, err := r.datafile.Stat()
+	dataStat, err := r.datafile.Stat()
 	if err != nil {
 		r.err = fmt.Errorf("invalid sstable, could not stat datafile: %v", err)
 		panic(r.err)
 	}
-	if r.filterfile == nil {
-		r.err = errors.New("nil filterfile")
-		panic(r.err)
-	}
-	stat, err = r.filterfile.Stat()
-	if err != nil {
-		r.err = fmt.Errorf("invalid sstable, could not stat filterfile: %v", err)
-		panic(r.err)
-	}
-	if r.metafile == nil {
-		r.err = errors.New("nil metafile")
-		panic(r.err)
-	}
-	stat, err = r.metafile.Stat()
-	if err != nil {
-		r.err = fmt.Errorf("invalid sstable, could not stat metafile: %v", err)
-		panic(r.err)
-	}
-	var footer [4]byte
-	if stat.Size() < int64(len(footer)) {
-		r.err = errors.New("invalid table, metafile size is too small")
-		return r
+	dataSize := dataStat.Size()
+	if sst.singleFile() {
+		if dataSize, r.err = r.readMeta(r.datafile, dataSize, dataSize); r.err != nil {
+			return r
+		}
+	} else {
+		if r.filterfile == nil {
+			r.err = errors.New("nil filterfile")
+			panic(r.err)
+		}
+		_, err = r.filterfile.Stat()
+		if err != nil {
+			r.err = fmt.Errorf("invalid sstable, could not stat filterfile: %v", err)
+			panic(r.err)
+		}
+		stat, err := r.metafile.Stat()
+		if err != nil {
+			r.err = fmt.Errorf("invalid sstable, could not stat metafile: %v", err)
+			panic(r.err)
+		}
+		if _, r.err = r.readMeta(r.metafile, stat.Size(), dataSize); r.err != nil {
+			return r
+		}
 	}
-	n, err := r.metafile.ReadAt(footer[:], stat.Size()-int64(len(footer)))
-	if err != nil && err != io.EOF {
-		r.err = fmt.Errorf("invalid table, could not read footer: %v", err)
+	if dataSize == 0 {
+		r.data = []byte{}
 		return r
 	}
-
-	offset, n := binary.Uvarint(footer[0:])
-
-	if n == 0 {
-		r.err = errors.New("invalid table, bad footer")
-		return r
+	r.data, err = syscall.Mmap(int(r.datafile.Fd()), 0, int(dataSize), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		r.data = nil
+		r.err = errors.Wrap(err, "failed to mmap the datafile for reading")
 	}
-	bufLength := stat.Size() - int64(offset) - int64(n)
-	r.blocks, r.err = r.readBlockInfo(offset, bufLength)
-	r.keyIndex, r.err = r.readIndex(offset)
 	return r
 }
@@ -17,19 +17,50 @@ import "os"
 /*
 SSTable encapsulates the files associated with an SSTable. Logically,
 an SSTable consists of a data file, a meta file and a filter file.
-The data file contains contiguous key and value pairs.
-Each key and value pair is prepended with the key length and value length,
-since these can differ across records.
-The meta file contains the index for the SSTable. The index maintains the key
-and the offset of the key in the data file.
+The data file contains blocks of contiguous key and value pairs.
+Each key and value pair is prepended with the length of the prefix its key shares with the
+previous key, the length of the rest of the key and the value length. Every few entries the key
+is stored in full, and each block ends with the offsets of these restart points.
+The meta file contains the sparse index for the SSTable. The index maintains the last
+key of every block of the data file and where the block is in the data file. The index is
+followed by the properties of the SSTable, and the meta file ends with a fixed size footer
+holding the format version and a magic number.
 The filter file contains th bloom filter for the SSTable.
 The id identifies an SSTable. The data, meta and filter file have the same name
 and differ only in the file extension.
-
+An SSTable can also be a single file, holding the data blocks followed by the filter and the
+contents of the meta file. The datafile is then the single file, and there is no meta or filter file.
  */
 type SSTable struct {
 	id         string
 	datafile   *os.File
 	metafile   *os.File
 	filterfile *os.File
+	//dir is the directory of a new SSTable, which is synced once the SSTable is written
+	dir        string
+	//path is the path of a new single file SSTable, which is written at tmpPath until it is complete
+	path       string
+	tmpPath    string
+}
+
+/*
+singleFile returns whether the SSTable is a single file.
+ */
+func (sst *SSTable) singleFile() bool {
+	return sst.metafile == nil
+}
+
+/*
+Close closes the data, meta and filter files of the SSTable.
+ */
+func (sst *SSTable) Close() (err error) {
+	for _, f := range []*os.File{sst.datafile, sst.metafile, sst.filterfile} {
+		if f == nil {
+			continue
+		}
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
 }
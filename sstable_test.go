@@ -0,0 +1,897 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package gokvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+type testRecord struct {
+	key, value []byte
+}
+
+/*
+writeTable writes the records, which must be sorted by key, to a new SSTable in dir and
+returns its id.
+ */
+func writeTable(t *testing.T, fs *FileSystem, records []testRecord) string {
+	sst, err := fs.NewSSTable()
+	if err != nil {
+		t.Fatal("failed to create sstable", err)
+	}
+	defer sst.Close()
+	w := NewWriterWithOptions(sst, fs.options)
+	for _, r := range records {
+		if err := w.Set(r.key, r.value); err != nil {
+			t.Fatal("failed to write record", err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("failed to close writer", err)
+	}
+	return sst.id
+}
+
+/*
+openReader returns a Reader for the SSTable with the id, which must be closed by the caller.
+ */
+func openReader(t *testing.T, fs *FileSystem, id string, options *Options) *Reader {
+	sst, err := fs.OpenSSTable(id)
+	if err != nil {
+		t.Fatal("failed to open sstable", err)
+	}
+	return NewReaderWithOptions(sst, options)
+}
+
+/*
+readAll iterates over the SSTable with a new Reader and returns the error of the iterator.
+ */
+func readAll(t *testing.T, fs *FileSystem, id string, options *Options) error {
+	r := openReader(t, fs, id, options)
+	defer r.Close()
+	iter := newTableIterator(r)
+	for iter.Next() {
+	}
+	return iter.Close()
+}
+
+func readTable(t *testing.T, fs *FileSystem, id string) []testRecord {
+	r := openReader(t, fs, id, fs.options)
+	defer r.Close()
+	iter := newTableIterator(r)
+	records := make([]testRecord, 0)
+	for iter.Next() {
+		records = append(records, testRecord{
+			key:   append([]byte(nil), iter.Key()...),
+			value: append([]byte(nil), iter.Value()...),
+		})
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal("failed to read sstable", err)
+	}
+	return records
+}
+
+func testFS(t *testing.T, opts Options) (*FileSystem, func()) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	return NewFS(dir, &opts), func() { os.RemoveAll(dir) }
+}
+
+/*
+blockCodecs returns the number of blocks of the SSTable written with each codec.
+ */
+func blockCodecs(t *testing.T, fs *FileSystem, id string) map[byte]int {
+	r := openReader(t, fs, id, fs.options)
+	defer r.Close()
+	codecs := make(map[byte]int)
+	for _, bi := range r.blocks {
+		var trailer [blockTrailerSize]byte
+		if _, err := r.datafile.ReadAt(trailer[:], int64(bi.start+bi.length-blockTrailerSize)); err != nil {
+			t.Fatal("failed to read block trailer", err)
+		}
+		codecs[trailer[0]]++
+	}
+	return codecs
+}
+
+func compressionTestRecords() []testRecord {
+	records := make([]testRecord, 0)
+	for j := 0; j < 5000; j++ {
+		value := bytes.Repeat([]byte{byte('a' + j%26)}, 50)
+		if j >= 2500 {
+			value = randomBytes(50)
+		}
+		records = append(records, testRecord{[]byte(fmt.Sprintf("key%05d", j)), value})
+	}
+	return records
+}
+
+func TestWriter_Compression(t *testing.T) {
+	records := compressionTestRecords()
+	codecs := map[Compression]byte{
+		NoCompression:     noCompressionBlock,
+		SnappyCompression: snappyCompressionBlock,
+		ZstdCompression:   zstdCompressionBlock,
+		LZ4Compression:    lz4CompressionBlock,
+	}
+	sizes := make(map[Compression]int64)
+	for compression, codec := range codecs {
+		fs, cleanup := testFS(t, Options{Compression: compression})
+		defer cleanup()
+		id := writeTable(t, fs, records)
+		stat, err := os.Stat(fs.path + "/" + id + dataFileExt)
+		if err != nil {
+			t.Fatal("failed to stat data file", err)
+		}
+		sizes[compression] = stat.Size()
+		if blockCodecs(t, fs, id)[codec] == 0 {
+			t.Errorf("%s: expected blocks written with codec %d", compression, codec)
+		}
+
+		got := readTable(t, fs, id)
+		if len(got) != len(records) {
+			t.Fatalf("%s: expected %d records, got %d", compression, len(records), len(got))
+		}
+		for j := range got {
+			if !bytes.Equal(got[j].key, records[j].key) || !bytes.Equal(got[j].value, records[j].value) {
+				t.Fatalf("%s: expected %s=%s, got %s=%s", compression, records[j].key, records[j].value, got[j].key, got[j].value)
+			}
+		}
+	}
+	for _, compression := range []Compression{SnappyCompression, ZstdCompression, LZ4Compression} {
+		if sizes[compression] >= sizes[NoCompression]*3/4 {
+			t.Errorf("%s: compressed size %d should be well below uncompressed size %d", compression, sizes[compression], sizes[NoCompression])
+		}
+	}
+}
+
+func TestWriter_CompressFlag(t *testing.T) {
+	fs, cleanup := testFS(t, Options{})
+	defer cleanup()
+	records := compressionTestRecords()
+	for _, compress := range []bool{true, false} {
+		sst, err := fs.NewSSTable()
+		if err != nil {
+			t.Fatal("failed to create sstable", err)
+		}
+		w := NewWriter(sst, compress)
+		for _, r := range records {
+			if err := w.Set(r.key, r.value); err != nil {
+				t.Fatal("failed to write record", err)
+			}
+		}
+		if err := w.Close(); err != nil {
+			t.Fatal("failed to close writer", err)
+		}
+		sst.Close()
+		if got := blockCodecs(t, fs, sst.id)[snappyCompressionBlock] > 0; got != compress {
+			t.Errorf("compress %v: expected snappy blocks %v, got %v", compress, compress, got)
+		}
+
+		//the reader uncompresses the blocks whatever the flag it is given
+		sst, err = fs.OpenSSTable(sst.id)
+		if err != nil {
+			t.Fatal("failed to open sstable", err)
+		}
+		r := NewReader(sst, !compress)
+		iter := newTableIterator(r)
+		n := 0
+		for ; iter.Next(); n++ {
+			if !bytes.Equal(iter.Key(), records[n].key) || !bytes.Equal(iter.Value(), records[n].value) {
+				t.Fatalf("compress %v: expected %s=%s, got %s=%s", compress, records[n].key, records[n].value, iter.Key(), iter.Value())
+			}
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal("failed to read sstable", err)
+		}
+		r.Close()
+		if n != len(records) {
+			t.Errorf("compress %v: expected %d records, got %d", compress, len(records), n)
+		}
+	}
+}
+
+func TestCompactor_RewritesWithConfiguredCodec(t *testing.T) {
+	fs, cleanup := testFS(t, Options{Compression: SnappyCompression})
+	defer cleanup()
+	records := compressionTestRecords()
+	expected := make(map[string]string)
+	for i, compression := range []Compression{SnappyCompression, LZ4Compression, NoCompression} {
+		fs.options.Compression = compression
+		part := make([]testRecord, 0)
+		for j := i; j < len(records); j += 3 {
+			part = append(part, records[j])
+			expected[string(records[j].key)] = string(records[j].value)
+		}
+		writeTable(t, fs, part)
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	c := NewCompactorWithOptions(fs.path, &Options{Compression: ZstdCompression, CompressionLevel: 9})
+	c.Compact()
+
+	files := GetDataFiles(fs.path)
+	if len(files) != 1 {
+		t.Fatalf("expected a single sstable after compaction, got %d", len(files))
+	}
+	codecs := blockCodecs(t, fs, files[0])
+	if codecs[snappyCompressionBlock] != 0 || codecs[lz4CompressionBlock] != 0 || codecs[zstdCompressionBlock] == 0 {
+		t.Errorf("expected the compacted sstable to be written with zstd, got %v", codecs)
+	}
+	got := readTable(t, fs, files[0])
+	if len(got) != len(expected) {
+		t.Fatalf("expected %d records, got %d", len(expected), len(got))
+	}
+	for _, r := range got {
+		if expected[string(r.key)] != string(r.value) {
+			t.Fatalf("unexpected value for %s", r.key)
+		}
+	}
+}
+
+func TestCompactor_MakeBuckets(t *testing.T) {
+	const mb = 1 << 20
+	//from the newest to the oldest
+	sizes := []uint64{10 * mb, 12 * mb, 9 * mb, 100 * mb, mb / 10, mb / 5, mb / 2, 30 * mb, 31 * mb}
+	files := make([]string, len(sizes))
+	meta := make(map[string]tableMeta)
+	for i, size := range sizes {
+		files[i] = fmt.Sprintf("t%d", i+1)
+		meta[files[i]] = tableMeta{size: size}
+	}
+	tests := []struct {
+		options  Options
+		expected string
+	}{
+		{Options{}, "t5,t6,t7 t1,t2,t3 t8,t9"},
+		{Options{MaxCompactionThreshold: 2}, "t5,t6 t1,t2 t8,t9"},
+		{Options{MinCompactionThreshold: 3}, "t5,t6,t7 t1,t2,t3"},
+		{Options{BucketHigh: 1.1}, "t5,t6,t7 t2,t3 t8,t9"},
+		{Options{BucketLow: 0.95}, "t5,t6,t7 t1,t2 t8,t9"},
+	}
+	for _, test := range tests {
+		c := &Compactor{fs: &FileSystem{options: &test.options}, meta: meta}
+		c.makeBuckets(files)
+		buckets := make([]string, 0)
+		for _, b := range c.buckets {
+			buckets = append(buckets, strings.Join(b.files, ","))
+		}
+		if got := strings.Join(buckets, " "); got != test.expected {
+			t.Errorf("%+v: expected buckets %s, got %s", test.options, test.expected, got)
+		}
+	}
+}
+
+func TestOpen_UnknownCompression(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := Open(dir, &Options{Compression: LZ4Compression + 1}); err != ErrUnknownCompression {
+		t.Errorf("expected ErrUnknownCompression, got %v", err)
+	}
+}
+
+func TestEncodeBlock_Fallback(t *testing.T) {
+	raw := randomBytes(blockSize)
+	compressible := bytes.Repeat([]byte("abcd"), blockSize/4)
+	for _, compression := range []Compression{SnappyCompression, ZstdCompression, LZ4Compression} {
+		b, err := encodeBlock(raw, compression, 0)
+		if err != nil {
+			t.Fatal("failed to encode block", err)
+		}
+		if b[len(b)-blockTrailerSize] != noCompressionBlock {
+			t.Errorf("%s: incompressible block should be stored uncompressed", compression)
+		}
+		b, err = encodeBlock(compressible, compression, 0)
+		if err != nil {
+			t.Fatal("failed to encode block", err)
+		}
+		if b[len(b)-blockTrailerSize] == noCompressionBlock {
+			t.Errorf("%s: compressible block should be compressed", compression)
+		}
+		decoded, err := decodeBlock(b, true)
+		if err != nil || !bytes.Equal(decoded, compressible) {
+			t.Errorf("%s: failed to decode compressed block %v", compression, err)
+		}
+	}
+}
+
+func flipByte(t *testing.T, name string, offset int64) {
+	f, err := os.OpenFile(name, os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal("failed to open file", err)
+	}
+	defer f.Close()
+	var b [1]byte
+	if _, err := f.ReadAt(b[:], offset); err != nil {
+		t.Fatal("failed to read file", err)
+	}
+	b[0] ^= 0x80
+	if _, err := f.WriteAt(b[:], offset); err != nil {
+		t.Fatal("failed to write file", err)
+	}
+}
+
+func expectCorruption(t *testing.T, err error, file string, offset int64) {
+	var corruption *ErrCorruption
+	if !errors.As(err, &corruption) {
+		t.Fatalf("expected *ErrCorruption, got %v", err)
+	}
+	if corruption.File != file || corruption.Offset != offset {
+		t.Errorf("expected corruption in %s at %d, got %s at %d", file, offset, corruption.File, corruption.Offset)
+	}
+}
+
+func TestReader_BlockCorruption(t *testing.T) {
+	fs, cleanup := testFS(t, Options{Compression: NoCompression})
+	defer cleanup()
+	id := writeTable(t, fs, compressionTestRecords())
+	r := openReader(t, fs, id, fs.options)
+	bi := r.blocks[3]
+	r.Close()
+	//the first byte of a block is the length of the prefix its first key shares with the previous key
+	dataFile := fs.path + "/" + id + dataFileExt
+	flipByte(t, dataFile, int64(bi.start))
+	expectCorruption(t, readAll(t, fs, id, fs.options), dataFile, int64(bi.start))
+
+	//without verification the damaged length is still caught when the block is decoded
+	opts := Options{Compression: NoCompression, SkipChecksumVerification: true}
+	expectCorruption(t, readAll(t, fs, id, &opts), dataFile, int64(bi.start))
+
+	//damage to a value goes unnoticed without verification
+	flipByte(t, dataFile, int64(bi.start))
+	contents, err := ioutil.ReadFile(dataFile)
+	if err != nil {
+		t.Fatal("failed to read file", err)
+	}
+	_, unshared, vallen, n := decodeEntry(contents[bi.start:])
+	flipByte(t, dataFile, int64(bi.start)+int64(n)+int64(unshared+vallen)-1)
+	if err := readAll(t, fs, id, &opts); err != nil {
+		t.Errorf("expected no error without verification, got %v", err)
+	}
+	expectCorruption(t, readAll(t, fs, id, fs.options), dataFile, int64(bi.start))
+}
+
+func TestReader_MetaCorruption(t *testing.T) {
+	fs, cleanup := testFS(t, Options{})
+	defer cleanup()
+	id := writeTable(t, fs, compressionTestRecords())
+	flipByte(t, fs.path+"/"+id+metaFileExt, 10)
+
+	r := openReader(t, fs, id, fs.options)
+	defer r.Close()
+	expectCorruption(t, r.err, fs.path+"/"+id+metaFileExt, 0)
+	if _, err := r.Get([]byte("key00001")); err != r.err {
+		t.Errorf("expected Get to return the corruption, got %v", err)
+	}
+}
+
+func TestDatabase_GetCorruption(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gokvstore")
+	if err != nil {
+		t.Fatal("failed to create directory", err)
+	}
+	defer os.RemoveAll(dir)
+	db, err := Open(dir, &Options{Compression: SnappyCompression})
+	if err != nil {
+		t.Fatal("failed to open database", err)
+	}
+	defer db.Close()
+	writeTestTable(t, db, map[string]string{"key": "value"})
+	files := GetDataFiles(dir)
+	flipByte(t, dir+"/"+files[0]+dataFileExt, 0)
+
+	_, err = db.Get([]byte("key"))
+	expectCorruption(t, err, dir+"/"+files[0]+dataFileExt, 0)
+}
+
+func TestBlockCache_Eviction(t *testing.T) {
+	c := newBlockCache(blockCacheShards * 1000)
+	for i := 0; i < 1000; i++ {
+		c.put(blockKey{"table", uint64(i * 100)}, make(block, 100))
+	}
+	if size := c.size(); size > blockCacheShards*1000 || size < blockCacheShards*500 {
+		t.Errorf("expected the cache to be nearly full, got %d bytes", size)
+	}
+	if _, ok := c.get(blockKey{"table", 99900}); !ok {
+		t.Errorf("expected the last block to be cached")
+	}
+	if _, ok := c.get(blockKey{"other", 99900}); ok {
+		t.Errorf("expected blocks to be keyed by table")
+	}
+	c.put(blockKey{"table", 0}, make(block, 1001))
+	if _, ok := c.get(blockKey{"table", 0}); ok {
+		t.Errorf("expected a block larger than a shard not to be cached")
+	}
+	if c.hits != 1 || c.misses != 2 {
+		t.Errorf("expected 1 hit and 2 misses, got %d and %d", c.hits, c.misses)
+	}
+	if newBlockCache(-1) != nil {
+		t.Errorf("expected a negative size to disable the cache")
+	}
+}
+
+func TestReader_Close(t *testing.T) {
+	fs, cleanup := testFS(t, Options{UseCompression: true})
+	defer cleanup()
+	records := compressionTestRecords()
+	id := writeTable(t, fs, records)
+	r := openReader(t, fs, id, fs.options)
+	if n := mappedFiles(t, fs.path); n != 1 {
+		t.Errorf("expected the data file to be mapped, got %d mappings", n)
+	}
+	var value []byte
+	for j := 0; j < 1000; j++ {
+		val, err := r.Get(records[j].key)
+		if err != nil || !bytes.Equal(val, records[j].value) {
+			t.Fatalf("expected %s, got %s, %v", records[j].value, val, err)
+		}
+		value = val
+	}
+	if err := r.Close(); err != nil {
+		t.Error("failed to close reader", err)
+	}
+	if n := openFiles(t, fs.path); n != 0 {
+		t.Errorf("expected no open files after Close, got %d", n)
+	}
+	if n := mappedFiles(t, fs.path); n != 0 {
+		t.Errorf("expected no mappings after Close, got %d", n)
+	}
+	if !bytes.Equal(value, records[999].value) {
+		t.Errorf("expected values to outlive the reader")
+	}
+	if _, err := r.Get(records[0].key); err != ErrReaderClosed {
+		t.Errorf("expected %v, got %v", ErrReaderClosed, err)
+	}
+}
+
+func TestReader_SparseIndex(t *testing.T) {
+	fs, cleanup := testFS(t, Options{UseCompression: true})
+	defer cleanup()
+	records := make([]testRecord, 0)
+	for j := 0; j < 1<<16; j += 2 {
+		records = append(records, testRecord{[]byte(fmt.Sprintf("key%06d", j)), []byte(fmt.Sprintf("value%06d", j))})
+	}
+	id := writeTable(t, fs, records)
+	r := openReader(t, fs, id, fs.options)
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal("failed to open reader", r.err)
+	}
+	if len(r.lastKeys) != len(r.blocks) || len(r.blocks) < 2 {
+		t.Fatalf("expected an index entry per block, got %d entries for %d blocks", len(r.lastKeys), len(r.blocks))
+	}
+	stat, err := os.Stat(fs.path + "/" + id + metaFileExt)
+	if err != nil {
+		t.Fatal("failed to stat meta file", err)
+	}
+	//an index entry is about the size of one key and a block holds many keys, the properties need a few more bytes
+	if stat.Size() > int64(len(r.blocks)*(len("key000000")+8)+footerSize+128) {
+		t.Errorf("expected a sparse index, meta file is %d bytes for %d blocks", stat.Size(), len(r.blocks))
+	}
+
+	for j := 0; j < 1<<16; j++ {
+		key := []byte(fmt.Sprintf("key%06d", j))
+		val, err := r.Get(key)
+		if j%2 == 0 && (err != nil || string(val) != fmt.Sprintf("value%06d", j)) {
+			t.Fatalf("expected value%06d, got %s, %v", j, val, err)
+		}
+		if j%2 == 1 && err != ErrKeyNotFound {
+			t.Fatalf("expected %s not to be found, got %s, %v", key, val, err)
+		}
+	}
+	for _, key := range []string{"a", "key", "key999999", "z"} {
+		if _, err := r.Get([]byte(key)); err != ErrKeyNotFound {
+			t.Errorf("expected %s not to be found, got %v", key, err)
+		}
+	}
+
+	//seeks between blocks land on the neighbouring keys
+	iter := newTableIterator(r)
+	defer iter.Close()
+	for i := range r.lastKeys[:len(r.lastKeys)-1] {
+		last := string(r.lastKeys[i])
+		var j int
+		fmt.Sscanf(last, "key%06d", &j)
+		between := []byte(fmt.Sprintf("key%06d", j+1))
+		if !iter.Seek(between) || string(iter.Key()) != fmt.Sprintf("key%06d", j+2) {
+			t.Fatalf("Seek(%s): expected key%06d, got %s", between, j+2, iter.Key())
+		}
+		if !iter.SeekForPrev(between) || string(iter.Key()) != last {
+			t.Fatalf("SeekForPrev(%s): expected %s, got %s", between, last, iter.Key())
+		}
+	}
+	if iter.Seek([]byte("z")) {
+		t.Errorf("expected Seek past the last key to fail")
+	}
+	if !iter.SeekForPrev([]byte("z")) || string(iter.Key()) != "key065534" {
+		t.Errorf("expected SeekForPrev past the last key to find key065534, got %s", iter.Key())
+	}
+}
+
+func TestReader_EmptyTable(t *testing.T) {
+	fs, cleanup := testFS(t, Options{UseCompression: true})
+	defer cleanup()
+	id := writeTable(t, fs, nil)
+	r := openReader(t, fs, id, fs.options)
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal("failed to open reader", r.err)
+	}
+	if _, err := r.Get([]byte("key")); err != ErrKeyNotFound {
+		t.Errorf("expected %v, got %v", ErrKeyNotFound, err)
+	}
+	iter := newTableIterator(r)
+	if iter.Next() || iter.Prev() || iter.Seek([]byte("key")) || iter.SeekForPrev([]byte("key")) {
+		t.Errorf("expected an empty table to have no keys")
+	}
+	if err := iter.Close(); err != nil {
+		t.Error("failed to iterate", err)
+	}
+}
+
+func TestWriter_PrefixCompression(t *testing.T) {
+	fs, cleanup := testFS(t, Options{Compression: NoCompression})
+	defer cleanup()
+	prefix := "tenant/0000000042/collection/orders/document/"
+	records := make([]testRecord, 0)
+	keyBytes := 0
+	for j := 0; j < 5000; j++ {
+		key := []byte(fmt.Sprintf("%s%08d", prefix, j))
+		keyBytes += len(key)
+		records = append(records, testRecord{key, []byte("v")})
+	}
+	id := writeTable(t, fs, records)
+	stat, err := os.Stat(fs.path + "/" + id + dataFileExt)
+	if err != nil {
+		t.Fatal("failed to stat data file", err)
+	}
+	//only the keys at restart points store the prefix
+	if stat.Size() > int64(keyBytes/4) {
+		t.Errorf("expected shared prefixes to be stripped, data file is %d bytes for %d bytes of keys", stat.Size(), keyBytes)
+	}
+	got := readTable(t, fs, id)
+	if len(got) != len(records) {
+		t.Fatalf("expected %d records, got %d", len(records), len(got))
+	}
+	for j := range records {
+		if !bytes.Equal(got[j].key, records[j].key) || !bytes.Equal(got[j].value, records[j].value) {
+			t.Fatalf("record %d: expected %s, got %s", j, records[j].key, got[j].key)
+		}
+	}
+}
+
+func TestChunkIterator_RestartPoints(t *testing.T) {
+	b := newBlockBuilder()
+	keys := make([]string, 0)
+	for j := 0; j < 5*blockRestartInterval+3; j++ {
+		key := fmt.Sprintf("key%04d", 2*j)
+		keys = append(keys, key)
+		b.add([]byte(key), []byte("value"+key))
+	}
+	block := b.finish()
+	if err := NewChunkIterator(block).check(); err != nil {
+		t.Fatal("failed to check block", err)
+	}
+
+	for j, key := range keys {
+		iter := NewChunkIterator(block)
+		if !iter.Seek([]byte(key)) || string(iter.Key()) != key || string(iter.Value()) != "value"+key {
+			t.Fatalf("seek %s: got %s %s", key, iter.Key(), iter.Value())
+		}
+		//a key between two entries
+		missing := []byte(fmt.Sprintf("key%04d", 2*j+1))
+		if !iter.SeekForPrev(missing) || string(iter.Key()) != key {
+			t.Fatalf("seek for prev %s: expected %s, got %s", missing, key, iter.Key())
+		}
+		ok := iter.Seek(missing)
+		if j == len(keys)-1 {
+			if ok {
+				t.Fatalf("seek %s: expected no key, got %s", missing, iter.Key())
+			}
+		} else if !ok || string(iter.Key()) != keys[j+1] {
+			t.Fatalf("seek %s: expected %s, got %s", missing, keys[j+1], iter.Key())
+		}
+	}
+
+	iter := NewChunkIterator(block)
+	for j := len(keys) - 1; j >= 0; j-- {
+		if !iter.Prev() || string(iter.Key()) != keys[j] {
+			t.Fatalf("prev: expected %s, got %s", keys[j], iter.Key())
+		}
+	}
+	if iter.Prev() || iter.Key() != nil {
+		t.Errorf("expected no key before the first, got %s", iter.Key())
+	}
+	if !iter.Next() || string(iter.Key()) != keys[0] {
+		t.Errorf("expected %s, got %s", keys[0], iter.Key())
+	}
+	if iter.SeekForPrev([]byte("a")) || !iter.Next() || string(iter.Key()) != keys[0] {
+		t.Errorf("expected to move to %s after seeking before the first key, got %s", keys[0], iter.Key())
+	}
+
+	//a restart point which does not start an entry
+	binary.LittleEndian.PutUint32(block[len(block)-8:], 3)
+	if err := NewChunkIterator(block).check(); err == nil {
+		t.Error("expected a bad restart point to be reported")
+	}
+}
+
+func TestReader_Properties(t *testing.T) {
+	fs, cleanup := testFS(t, Options{Compression: SnappyCompression})
+	defer cleanup()
+	records := make([]testRecord, 0)
+	for j := 0; j < 3000; j++ {
+		value := []byte(fmt.Sprintf("value%06d", j))
+		if j%3 == 0 {
+			value = []byte(deleteMarker)
+		}
+		records = append(records, testRecord{[]byte(fmt.Sprintf("key%06d", j)), value})
+	}
+	before := time.Now()
+	id := writeTable(t, fs, records)
+	r := openReader(t, fs, id, fs.options)
+	defer r.Close()
+	if r.err != nil {
+		t.Fatal("failed to open reader", r.err)
+	}
+	props := r.Properties()
+	if props.NumEntries != 3000 || props.NumTombstones != 1000 {
+		t.Errorf("expected 3000 entries and 1000 tombstones, got %d and %d", props.NumEntries, props.NumTombstones)
+	}
+	if string(props.MinKey) != "key000000" || string(props.MaxKey) != "key002999" {
+		t.Errorf("expected keys from key000000 to key002999, got %s to %s", props.MinKey, props.MaxKey)
+	}
+	stat, err := os.Stat(fs.path + "/" + id + dataFileExt)
+	if err != nil {
+		t.Fatal("failed to stat data file", err)
+	}
+	if props.DataSize != uint64(stat.Size()) || props.RawSize <= props.DataSize {
+		t.Errorf("expected %d bytes of compressed data, got %d from %d raw bytes", stat.Size(), props.DataSize, props.RawSize)
+	}
+	if props.CreationTime.Before(before.Truncate(time.Millisecond)) || props.CreationTime.After(time.Now()) {
+		t.Errorf("expected the table to be created after %v, got %v", before, props.CreationTime)
+	}
+	if props.Compression != SnappyCompression {
+		t.Errorf("expected %s, got %s", SnappyCompression, props.Compression)
+	}
+
+	empty := openReader(t, fs, writeTable(t, fs, nil), fs.options)
+	defer empty.Close()
+	if props := empty.Properties(); empty.err != nil || props.NumEntries != 0 || props.MinKey != nil || props.MaxKey != nil {
+		t.Errorf("expected no entries in an empty table, got %+v, %v", props, empty.err)
+	}
+}
+
+func TestReader_Footer(t *testing.T) {
+	fs, cleanup := testFS(t, Options{})
+	defer cleanup()
+	records := compressionTestRecords()
+	id := writeTable(t, fs, records)
+	metaFile := fs.path + "/" + id + metaFileExt
+	meta, err := ioutil.ReadFile(metaFile)
+	if err != nil {
+		t.Fatal("failed to read meta file", err)
+	}
+	writeMeta := func(meta []byte) {
+		binary.LittleEndian.PutUint32(meta[len(meta)-12:], crc32.Checksum(meta[:len(meta)-12], crcTable))
+		if err := ioutil.WriteFile(metaFile, meta, 0644); err != nil {
+			t.Fatal("failed to write meta file", err)
+		}
+	}
+
+	//a table written by the first version of the format, whose footer only locates the properties
+	f, err := decodeFooter(meta)
+	if err != nil {
+		t.Fatal("failed to decode footer", err)
+	}
+	v1 := append([]byte(nil), meta[:len(meta)-footerSize]...)
+	v1 = append(v1, make([]byte, footerSizeV1)...)
+	h := v1[len(v1)-footerSizeV1:]
+	binary.LittleEndian.PutUint32(h[0:], f.numBlocks)
+	binary.LittleEndian.PutUint64(h[4:], f.propsOffset)
+	binary.LittleEndian.PutUint32(h[12:], 1)
+	binary.LittleEndian.PutUint64(h[20:], tableMagic)
+	writeMeta(v1)
+	got := readTable(t, fs, id)
+	if len(got) != len(records) {
+		t.Fatalf("expected %d records from a version 1 table, got %d", len(records), len(got))
+	}
+	for j := range records {
+		if !bytes.Equal(got[j].key, records[j].key) || !bytes.Equal(got[j].value, records[j].value) {
+			t.Fatalf("record %d: expected %s, got %s", j, records[j].key, got[j].key)
+		}
+	}
+
+	//a table written by a later version of the format
+	binary.LittleEndian.PutUint32(meta[len(meta)-footerTrailerSize:], tableFormatVersion+1)
+	writeMeta(meta)
+	r := openReader(t, fs, id, fs.options)
+	r.Close()
+	expectCorruption(t, r.err, metaFile, int64(len(meta)-footerTrailerSize))
+	if !errors.Is(r.err, ErrUnknownFormatVersion) {
+		t.Errorf("expected ErrUnknownFormatVersion, got %v", r.err)
+	}
+
+	//a file which is not an SSTable
+	flipByte(t, metaFile, int64(len(meta)-1))
+	r = openReader(t, fs, id, fs.options)
+	r.Close()
+	expectCorruption(t, r.err, metaFile, int64(len(meta)-footerTrailerSize))
+}
+
+func TestWriter_SingleFile(t *testing.T) {
+	fs, cleanup := testFS(t, Options{UseCompression: true, SingleFileTables: true})
+	defer cleanup()
+	records := compressionTestRecords()
+	sst, err := fs.NewSSTable()
+	if err != nil {
+		t.Fatal("failed to create sstable", err)
+	}
+	w := NewWriterWithOptions(sst, fs.options)
+	for _, r := range records {
+		if err := w.Set(r.key, r.value); err != nil {
+			t.Fatal("failed to write record", err)
+		}
+	}
+	//the table is only visible once it is complete
+	if files := GetDataFiles(fs.path); len(files) != 0 {
+		t.Errorf("expected no table before the writer is closed, got %v", files)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal("failed to close writer", err)
+	}
+	names, err := filepath.Glob(fs.path + "/*")
+	if err != nil {
+		t.Fatal("failed to list files", err)
+	}
+	if len(names) != 1 || names[0] != fs.path+"/"+sst.id+tableFileExt {
+		t.Fatalf("expected a single file for the table, got %v", names)
+	}
+	if files := GetDataFiles(fs.path); len(files) != 1 || files[0] != sst.id {
+		t.Errorf("expected table %s, got %v", sst.id, files)
+	}
+
+	got := readTable(t, fs, sst.id)
+	if len(got) != len(records) {
+		t.Fatalf("expected %d records, got %d", len(records), len(got))
+	}
+	for j := range records {
+		if !bytes.Equal(got[j].key, records[j].key) || !bytes.Equal(got[j].value, records[j].value) {
+			t.Fatalf("record %d: expected %s, got %s", j, records[j].key, got[j].key)
+		}
+	}
+	r := openReader(t, fs, sst.id, fs.options)
+	defer r.Close()
+	if props := r.Properties(); props.NumEntries != uint64(len(records)) || props.DataSize != uint64(len(r.data)) {
+		t.Errorf("expected %d entries in %d bytes, got %+v", len(records), len(r.data), props)
+	}
+	filter, err := r.readFilter()
+	if err != nil {
+		t.Fatal("failed to read filter", err)
+	}
+	for _, rec := range records {
+		if !filter.Test(rec.key) {
+			t.Fatalf("expected the filter to hold %s", rec.key)
+		}
+	}
+}
+
+func TestWriter_SyncsDirectory(t *testing.T) {
+	for _, singleFile := range []bool{false, true} {
+		fs, cleanup := testFS(t, Options{})
+		defer cleanup()
+		sst, err := fs.newSSTable(singleFile)
+		if err != nil {
+			t.Fatal("failed to create sstable", err)
+		}
+		//the writer reports that the directory of the table could not be synced
+		sst.dir = fs.path + "/missing"
+		w := NewWriterWithOptions(sst, fs.options)
+		if err := w.Set([]byte("key"), []byte("value")); err != nil {
+			t.Fatal("failed to write record", err)
+		}
+		if err := w.Close(); err == nil || !strings.Contains(err.Error(), "failed to sync the sstable directory") {
+			t.Errorf("single file %v: expected the directory sync to fail, got %v", singleFile, err)
+		}
+	}
+}
+
+func TestReader_SingleFileCorruption(t *testing.T) {
+	fs, cleanup := testFS(t, Options{SingleFileTables: true})
+	defer cleanup()
+	id := writeTable(t, fs, compressionTestRecords())
+	r := openReader(t, fs, id, fs.options)
+	metaOffset, first := uint64(len(r.data)), r.blocks[0]
+	r.Close()
+	name := fs.path + "/" + id + tableFileExt
+
+	//damage to the metadata, which starts with the filter
+	flipByte(t, name, int64(metaOffset)+10)
+	r = openReader(t, fs, id, fs.options)
+	r.Close()
+	expectCorruption(t, r.err, name, int64(metaOffset))
+
+	flipByte(t, name, int64(metaOffset)+10)
+	flipByte(t, name, int64(first.start))
+	expectCorruption(t, readAll(t, fs, id, fs.options), name, int64(first.start))
+}
+
+//legacyTable is an SSTable written before SSTables had a footer
+const legacyTable = "test_data/2019-05-14T14-53-07.348"
+
+func TestDecodeLegacyMeta(t *testing.T) {
+	meta, err := ioutil.ReadFile(legacyTable + metaFileExt)
+	if err != nil {
+		t.Fatal("failed to read meta file", err)
+	}
+	data, err := ioutil.ReadFile(legacyTable + dataFileExt)
+	if err != nil {
+		t.Fatal("failed to read data file", err)
+	}
+	lm, err := decodeLegacyMeta(meta)
+	if err != nil {
+		t.Fatal("failed to decode meta file", err)
+	}
+	if len(lm.keys) == 0 || len(lm.blocks) < 2 {
+		t.Fatalf("expected keys in several blocks, got %d keys in %d blocks", len(lm.keys), len(lm.blocks))
+	}
+	//every key of the index is found in order in the blocks, and each block ends with its last key
+	n := 0
+	for j, bi := range lm.blocks {
+		b, err := decodeLegacyBlock(data[bi.start : bi.start+bi.length])
+		if err != nil {
+			t.Fatalf("block %d: failed to decode %v", j, err)
+		}
+		iter := NewChunkIterator(b)
+		for iter.Next() {
+			if n >= len(lm.keys) || !bytes.Equal(iter.Key(), lm.keys[n].Key) {
+				t.Fatalf("block %d: unexpected key %s at %d", j, iter.Key(), n)
+			}
+			n++
+		}
+		if iter.err != nil {
+			t.Fatalf("block %d: %v", j, iter.err)
+		}
+		if !bytes.Equal(lm.keys[n-1].Key, lm.lastKeys[j]) {
+			t.Errorf("block %d: expected last key %s, got %s", j, lm.keys[n-1].Key, lm.lastKeys[j])
+		}
+	}
+	if n != len(lm.keys) {
+		t.Errorf("expected %d keys, got %d", len(lm.keys), n)
+	}
+
+	if _, err := decodeLegacyMeta(meta[:len(meta)/2]); err == nil {
+		t.Error("expected a truncated meta file to fail to decode")
+	}
+	if _, err := decodeLegacyBlock(data[:5]); err == nil {
+		t.Error("expected a truncated entry to fail to decode")
+	}
+}
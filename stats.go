@@ -0,0 +1,59 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package gokvstore
+
+import "sync/atomic"
+
+/*
+Stats reports counters about the work done by the database since it was opened.
+
+BlockCacheHits - is the number of SSTable blocks found in the block cache.
+
+BlockCacheMisses - is the number of SSTable blocks read from disk because they were not in the block cache.
+
+BlockCacheSize - is the number of bytes held by the block cache.
+
+Compactions - is the number of compactions done by the background compaction, whatever the number of SSTables
+each of them wrote.
+
+CompactionErrors - is the number of background compactions which failed. The SSTables of a failed
+compaction are left as they were, and compacted again later.
+
+TombstonesPurged - is the number of deleted keys dropped by the background compaction, together with their
+older values.
+ */
+type Stats struct {
+	BlockCacheHits   uint64
+	BlockCacheMisses uint64
+	BlockCacheSize   int
+	Compactions      uint64
+	CompactionErrors uint64
+	TombstonesPurged uint64
+}
+
+/*
+Stats returns the current counters of the database.
+ */
+func (db *Database) Stats() Stats {
+	var stats Stats
+	if db.blocks != nil {
+		stats.BlockCacheHits = atomic.LoadUint64(&db.blocks.hits)
+		stats.BlockCacheMisses = atomic.LoadUint64(&db.blocks.misses)
+		stats.BlockCacheSize = db.blocks.size()
+	}
+	stats.Compactions = atomic.LoadUint64(&db.compactionCount)
+	stats.CompactionErrors = atomic.LoadUint64(&db.compactionErrors)
+	stats.TombstonesPurged = atomic.LoadUint64(&db.tombstonesPurged)
+	return stats
+}
@@ -0,0 +1,179 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package gokvstore
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/tylertreat/BoomFilters"
+)
+
+const (
+	//defaultMaxOpenFiles is the number of files the database may keep open if the options do not say.
+	defaultMaxOpenFiles = 1000
+	//reservedOpenFiles is the number of files kept open by the database besides the SSTables, such as
+	//the lock file and the write ahead log.
+	reservedOpenFiles = 10
+)
+
+/*
+cachedTable is an SSTable held open by the table cache. The key index and the bloom filter are held in
+memory, so only the data file is kept open and mapped. A table is shared by all the readers of the database and
+stays open while it is referenced, even after it is evicted from the cache.
+ */
+type cachedTable struct {
+	id      string
+	reader  *Reader
+	filter  *boom.ScalableBloomFilter
+	refs    int
+	evicted bool
+}
+
+/*
+tableCache keeps the most recently used SSTables open, up to its capacity. Tables are looked up by id
+and must be released once the caller is done with them. When the cache is full, the least recently used
+table is evicted and its reader is closed as soon as it is no longer referenced.
+ */
+type tableCache struct {
+	fs       *FileSystem
+	options  *Options
+	blocks   *blockCache
+	capacity int
+	lock     sync.Mutex
+	tables   map[string]*list.Element
+	lru      *list.List
+}
+
+/*
+get returns the SSTable with the id, opening it if it is not in the cache.
+The table must be released by the caller.
+ */
+func (c *tableCache) get(id string) (*cachedTable, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.tables[id]; ok {
+		c.lru.MoveToFront(e)
+		t := e.Value.(*cachedTable)
+		t.refs++
+		return t, nil
+	}
+	t, err := c.open(id)
+	if err != nil {
+		return nil, err
+	}
+	t.refs++
+	c.tables[id] = c.lru.PushFront(t)
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+	return t, nil
+}
+
+/*
+release drops a reference to a table returned by get.
+ */
+func (c *tableCache) release(t *cachedTable) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	t.refs--
+	if t.refs == 0 && t.evicted {
+		t.reader.Close()
+	}
+}
+
+/*
+evict removes the table with the id from the cache, for example when the SSTable is deleted.
+ */
+func (c *tableCache) evict(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if e, ok := c.tables[id]; ok {
+		c.remove(e)
+	}
+}
+
+/*
+close evicts every table. Tables still in use are closed when they are released.
+ */
+func (c *tableCache) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+func (c *tableCache) remove(e *list.Element) {
+	t := e.Value.(*cachedTable)
+	c.lru.Remove(e)
+	delete(c.tables, t.id)
+	t.evicted = true
+	if t.refs == 0 {
+		t.reader.Close()
+	}
+}
+
+func (c *tableCache) open(id string) (*cachedTable, error) {
+	sst, err := c.fs.OpenSSTable(id)
+	if err != nil {
+		return nil, err
+	}
+	r := NewReaderWithOptions(sst, c.options)
+	if r.err != nil {
+		r.Close()
+		return nil, r.err
+	}
+	r.id, r.cache = id, c.blocks
+	filter, err := r.readFilter()
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+	//the index and the filter are in memory, only the data file is read from now on
+	if r.metafile != nil {
+		r.metafile.Close()
+		r.filterfile.Close()
+		r.metafile, r.filterfile = nil, nil
+	}
+	r.filter = nil
+	return &cachedTable{
+		id:     id,
+		reader: r,
+		filter: filter,
+	}, nil
+}
+
+/*
+newTableCache returns a table cache which keeps as many SSTables open as MaxOpenFiles allows. The blocks
+of the tables are shared through the block cache, if it is not nil.
+ */
+func newTableCache(fs *FileSystem, options *Options, blocks *blockCache) *tableCache {
+	maxOpenFiles := options.MaxOpenFiles
+	if maxOpenFiles <= 0 {
+		maxOpenFiles = defaultMaxOpenFiles
+	}
+	capacity := maxOpenFiles - reservedOpenFiles
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &tableCache{
+		fs:       fs,
+		options:  options,
+		blocks:   blocks,
+		capacity: capacity,
+		tables:   make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
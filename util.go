@@ -13,6 +13,7 @@
 package gokvstore
 
 import (
+	"io"
 	"os"
 	"path"
 	"path/filepath"
@@ -21,6 +22,7 @@ import (
 	"time"
 
 	"github.com/maneeshchaturvedi/gokvstore/memfs"
+	"github.com/maneeshchaturvedi/gokvstore/wal"
 	"github.com/pkg/errors"
 	"fmt"
 )
@@ -51,7 +53,8 @@ func ArrToMemdb(arr []memfs.Record) (memdb *memfs.Memtable) {
 }
 
 /*
-GetDataFiles returns the names of the data files in the specified directory
+GetDataFiles returns the names of the data files in the specified directory, and of the SSTables
+written as a single file. Single file SSTables which are not complete are left out.
  */
 func GetDataFiles(dir string) []string {
 	_, err := os.Stat(dir)
@@ -62,7 +65,7 @@ func GetDataFiles(dir string) []string {
 	filepath.Walk(dir, func(dir string, f os.FileInfo, _ error) error {
 		if !f.IsDir() {
 			r, err := regexp.MatchString(dataFileExt, f.Name())
-			if err == nil && r {
+			if (err == nil && r) || path.Ext(f.Name()) == tableFileExt {
 				name := strings.TrimSuffix(f.Name(), path.Ext(f.Name()))
 				files = append(files, name)
 			}
@@ -80,26 +83,100 @@ func TimeTrack(start time.Time, name string) string{
 	return fmt.Sprintf("%s took %s", name, elapsed)
 }
 
-func WriteLog(file *os.File, data []byte) (err error) {
-	_, err = file.Write(data)
-	if err != nil {
-		return err
-	}
-	return nil
-}
-
 /*
 RotateLog rotates the write ahead log whenever the contents of a memtable are flushed to disk.
  */
 func RotateLog(db *Database) (err error) {
+	if err := db.log.Close(); err != nil {
+		return errors.Wrap(err, "failed to close current log")
+	}
 	if err := db.fs.RenameFile(CurrentLog, OldLog); err != nil {
 		return errors.Wrap(err, "failed to rename current log")
 	}
 	if err := db.fs.DeleteFile(OldLog); err != nil {
 		return errors.Wrap(err, "failed to delete old log")
 	}
-	if db.log, err = db.fs.OpenLogFile(CurrentLog); err != nil {
+	file, err := db.fs.OpenLogFile(CurrentLog)
+	if err != nil {
 		return errors.Wrap(err, "failed to create new log")
 	}
+	db.log = wal.NewWriter(file)
+	return nil
+}
+
+/*
+ReplayLog reads the write ahead log with the specified name and applies every record it contains to
+the memtable of the database. Replay stops cleanly at a torn tail left by a crash, which is truncated
+unless the database is read only, so that new records are not appended after it. A missing log is not an error.
+ */
+func ReplayLog(db *Database, name string) (err error) {
+	file, err := db.fs.OpenFile(name, os.O_RDONLY, os.ModePerm)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "failed to open log")
+	}
+	defer file.Close()
+	r := wal.NewReader(file)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read log at offset %d", r.Offset())
+		}
+		db.memdb.Insert(toMemRecord(rec))
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat log")
+	}
+	if stat.Size() > r.Offset() && !db.options.ReadOnly {
+		if err := db.fs.TruncateFile(name, r.Offset()); err != nil {
+			return errors.Wrap(err, "failed to truncate torn log")
+		}
+	}
+	return nil
+}
+
+func toMemRecord(rec wal.Record) memfs.Record {
+	if rec.Type == wal.TypeDelete {
+		return memfs.Record{
+			Key: rec.Key,
+			Val: []byte(deleteMarker),
+		}
+	}
+	return memfs.Record{
+		Key: rec.Key,
+		Val: rec.Value,
+	}
+}
+
+/*
+successor returns the smallest key which is greater than key, which turns an inclusive upper bound
+into an exclusive one.
+ */
+func successor(key []byte) []byte {
+	next := make([]byte, len(key)+1)
+	copy(next, key)
+	return next
+}
+
+/*
+prefixUpperBound returns the smallest key which is greater than every key starting with prefix, to be used
+as the exclusive upper bound of a prefix scan. Trailing 0xff bytes cannot be incremented, so they are dropped
+before incrementing the last byte. A prefix made only of 0xff bytes has no upper bound, and nil is returned.
+ */
+func prefixUpperBound(prefix []byte) []byte {
+	for i := len(prefix) - 1; i >= 0; i-- {
+		if prefix[i] != 0xff {
+			upper := make([]byte, i+1)
+			copy(upper, prefix)
+			upper[i]++
+			return upper
+		}
+	}
 	return nil
 }
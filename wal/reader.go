@@ -0,0 +1,136 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+)
+
+/*
+Reader reads the records of a write ahead log in the order they were written.
+ */
+type Reader struct {
+	r       *bufio.Reader
+	offset  int64
+	header  [headerSize]byte
+	pending []Record
+}
+
+/*
+Next returns the next record in the log. It returns io.EOF at the end of the log. A record which was only
+partially written, or whose checksum does not match while being the last one in the log, was torn by a crash
+and is also reported as io.EOF. A record whose header was written but which ends past the end of the log is
+only torn if no complete record follows its header, otherwise its length was damaged and it is reported as
+ErrCorrupt. A damaged record followed by further data returns ErrCorrupt, and so does a
+record whose length is larger than MaxRecordSize.
+The records of a batch are returned one at a time, once the whole batch has been read and verified.
+ */
+func (r *Reader) Next() (Record, error) {
+	if len(r.pending) > 0 {
+		rec := r.pending[0]
+		r.pending = r.pending[1:]
+		return rec, nil
+	}
+	if _, err := io.ReadFull(r.r, r.header[:]); err != nil {
+		return Record{}, io.EOF
+	}
+	length := int64(binary.LittleEndian.Uint32(r.header[4:]))
+	if length > MaxRecordSize {
+		return Record{}, ErrCorrupt
+	}
+	payload := make([]byte, length+1)
+	payload[0] = r.header[8]
+	if n, err := io.ReadFull(r.r, payload[1:]); err != nil {
+		return Record{}, r.truncated(payload[1 : 1+n])
+	}
+	if crc32.Checksum(payload, crcTable) != binary.LittleEndian.Uint32(r.header[:]) {
+		return Record{}, r.damaged()
+	}
+	if RecordType(payload[0]) == TypeBatch {
+		records, ok := decodeBatch(payload[1:])
+		if !ok {
+			return Record{}, r.damaged()
+		}
+		r.offset += headerSize + length
+		r.pending = records
+		return r.Next()
+	}
+	rec, ok := decodeRecord(RecordType(payload[0]), payload[1:])
+	if !ok {
+		return Record{}, r.damaged()
+	}
+	r.offset += headerSize + length
+	return rec, nil
+}
+
+/*
+Offset returns the offset in the log just past the last record, or batch, read by Next.
+After Next has returned io.EOF, anything beyond Offset is a torn tail which can be truncated.
+ */
+func (r *Reader) Offset() int64 {
+	return r.offset
+}
+
+/*
+truncated returns the error of a record which ends past the end of the log, given the rest of the log after
+its header. A crash only tears the last write to the log, so the record is a torn tail, reported as io.EOF,
+unless a complete record can be found in the rest of the log. Its length was then damaged in the middle of
+the log, and the records after it must not be discarded, so ErrCorrupt is returned.
+ */
+func (r *Reader) truncated(rest []byte) error {
+	for i := 0; i+headerSize <= len(rest); i++ {
+		end := int64(i) + headerSize + int64(binary.LittleEndian.Uint32(rest[i+4:]))
+		if end > int64(len(rest)) {
+			continue
+		}
+		if crc32.Checksum(rest[i+8:end], crcTable) == binary.LittleEndian.Uint32(rest[i:]) {
+			return ErrCorrupt
+		}
+	}
+	return io.EOF
+}
+
+func (r *Reader) damaged() error {
+	if _, err := r.r.Peek(1); err == io.EOF {
+		return io.EOF
+	}
+	return ErrCorrupt
+}
+
+func decodeRecord(t RecordType, payload []byte) (Record, bool) {
+	switch t {
+	case TypePut:
+		keyLen, n := binary.Uvarint(payload)
+		if n <= 0 || uint64(len(payload)-n) < keyLen {
+			return Record{}, false
+		}
+		key := payload[n : n+int(keyLen)]
+		return Record{Type: t, Key: key, Value: payload[n+int(keyLen):]}, true
+	case TypeDelete:
+		return Record{Type: t, Key: payload}, true
+	}
+	return Record{}, false
+}
+
+/*
+NewReader returns a Reader over the contents of a log.
+ */
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		r: bufio.NewReader(r),
+	}
+}
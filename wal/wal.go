@@ -0,0 +1,131 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+/*
+Package wal implements the write ahead log of the database.
+
+The log is a sequence of framed records. Each record is laid out as
+
+	checksum (4 bytes) | length (4 bytes) | type (1 byte) | payload (length bytes)
+
+The checksum is the CRC32C of the type and the payload. The length and checksum are stored
+little endian. The payload of a put record is the uvarint encoded key length, the key and the
+value. The payload of a delete record is the key. The payload of a batch record is the uvarint encoded
+number of records in the batch followed by, for each record, its type, the uvarint encoded key length, the key,
+the uvarint encoded value length and the value. A batch is written and verified as a single record, so either
+all or none of its records are read back.
+ */
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+
+	"github.com/pkg/errors"
+)
+
+/*
+RecordType identifies the operation logged by a record.
+ */
+type RecordType byte
+
+const (
+	//TypePut is the type of a record which sets the value of a key.
+	TypePut RecordType = 1
+	//TypeDelete is the type of a record which deletes a key.
+	TypeDelete RecordType = 2
+	//TypeBatch is the type of a record which groups several put and delete records.
+	TypeBatch RecordType = 3
+	//headerSize is the size of the checksum, length and type preceding every payload.
+	headerSize = 9
+	//MaxRecordSize is the largest payload of a record. A larger length read from the log is damaged.
+	MaxRecordSize = 64 << 20
+)
+
+var (
+	//ErrCorrupt is returned by the Reader if a record which is followed by other records fails
+	//its checksum or cannot be decoded.
+	ErrCorrupt = errors.New("wal: corrupt record")
+	//ErrRecordTooLarge is returned by the Writer for a record whose payload is larger than MaxRecordSize.
+	ErrRecordTooLarge = errors.New("wal: record too large")
+	crcTable   = crc32.MakeTable(crc32.Castagnoli)
+)
+
+/*
+Record is a single operation in the write ahead log. Value is nil for a delete.
+A batch record carries its encoded records in Value and is created by NewBatchRecord.
+ */
+type Record struct {
+	Type  RecordType
+	Key   []byte
+	Value []byte
+}
+
+/*
+NewBatchRecord returns a record which writes all the records to the log as a single atomic entry.
+ */
+func NewBatchRecord(records []Record) Record {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(records)))
+	payload := append([]byte(nil), tmp[:n]...)
+	for _, r := range records {
+		payload = append(payload, byte(r.Type))
+		n = binary.PutUvarint(tmp[:], uint64(len(r.Key)))
+		payload = append(payload, tmp[:n]...)
+		payload = append(payload, r.Key...)
+		n = binary.PutUvarint(tmp[:], uint64(len(r.Value)))
+		payload = append(payload, tmp[:n]...)
+		payload = append(payload, r.Value...)
+	}
+	return Record{Type: TypeBatch, Value: payload}
+}
+
+func decodeBatch(payload []byte) ([]Record, bool) {
+	count, n := binary.Uvarint(payload)
+	if n <= 0 {
+		return nil, false
+	}
+	payload = payload[n:]
+	records := make([]Record, 0, count)
+	for i := uint64(0); i < count; i++ {
+		if len(payload) == 0 {
+			return nil, false
+		}
+		t := RecordType(payload[0])
+		if t != TypePut && t != TypeDelete {
+			return nil, false
+		}
+		key, rest, ok := decodeSlice(payload[1:])
+		if !ok {
+			return nil, false
+		}
+		value, rest, ok := decodeSlice(rest)
+		if !ok {
+			return nil, false
+		}
+		if t == TypeDelete {
+			value = nil
+		}
+		records = append(records, Record{Type: t, Key: key, Value: value})
+		payload = rest
+	}
+	return records, len(payload) == 0
+}
+
+func decodeSlice(src []byte) ([]byte, []byte, bool) {
+	length, n := binary.Uvarint(src)
+	if n <= 0 || uint64(len(src)-n) < length {
+		return nil, nil, false
+	}
+	return src[n : n+int(length)], src[n+int(length):], true
+}
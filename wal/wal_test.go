@@ -0,0 +1,193 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package wal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTestLog(t *testing.T, records []Record) *os.File {
+	file, err := ioutil.TempFile("", "wal")
+	if err != nil {
+		t.Fatal("failed to create log", err)
+	}
+	w := NewWriter(file)
+	for _, r := range records {
+		if err := w.Append(r); err != nil {
+			t.Fatal("failed to append", err)
+		}
+	}
+	return file
+}
+
+func readTestLog(t *testing.T, name string) ([]Record, error) {
+	data, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal("failed to read log", err)
+	}
+	r := NewReader(bytes.NewReader(data))
+	records := make([]Record, 0)
+	for {
+		rec, err := r.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return records, err
+		}
+		records = append(records, rec)
+	}
+}
+
+var testRecords = []Record{
+	{Type: TypePut, Key: []byte("a:b"), Value: []byte("c;d")},
+	{Type: TypeDelete, Key: []byte("a:b")},
+	{Type: TypePut, Key: []byte("key"), Value: []byte("value")},
+}
+
+func TestReader_RoundTrip(t *testing.T) {
+	file := writeTestLog(t, testRecords)
+	defer os.Remove(file.Name())
+	file.Close()
+
+	records, err := readTestLog(t, file.Name())
+	if err != nil {
+		t.Fatal("failed to read records", err)
+	}
+	if len(records) != len(testRecords) {
+		t.Fatalf("expected %d records, got %d", len(testRecords), len(records))
+	}
+	for i, r := range records {
+		if r.Type != testRecords[i].Type || !bytes.Equal(r.Key, testRecords[i].Key) ||
+			!bytes.Equal(r.Value, testRecords[i].Value) {
+			t.Errorf("expected %v, got %v", testRecords[i], r)
+		}
+	}
+}
+
+func TestReader_TornTail(t *testing.T) {
+	file := writeTestLog(t, testRecords)
+	defer os.Remove(file.Name())
+	stat, _ := file.Stat()
+	file.Close()
+
+	for cut := int64(1); cut < 13; cut++ {
+		os.Truncate(file.Name(), stat.Size()-cut)
+		records, err := readTestLog(t, file.Name())
+		if err != nil {
+			t.Fatalf("torn tail should not be an error, got %v", err)
+		}
+		if len(records) != len(testRecords)-1 {
+			t.Errorf("expected %d records, got %d", len(testRecords)-1, len(records))
+		}
+	}
+}
+
+func TestReader_Corrupt(t *testing.T) {
+	file := writeTestLog(t, testRecords)
+	defer os.Remove(file.Name())
+	file.Close()
+
+	data, _ := ioutil.ReadFile(file.Name())
+	data[headerSize+1] ^= 0xff
+	ioutil.WriteFile(file.Name(), data, os.ModePerm)
+	_, err := readTestLog(t, file.Name())
+	if err != ErrCorrupt {
+		t.Errorf("expected %v, got %v", ErrCorrupt, err)
+	}
+
+	data[headerSize+1] ^= 0xff
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile(file.Name(), data, os.ModePerm)
+	records, err := readTestLog(t, file.Name())
+	if err != nil || len(records) != len(testRecords)-1 {
+		t.Errorf("damaged last record should be treated as a torn tail, got %d records and %v", len(records), err)
+	}
+}
+
+func TestReader_DamagedLength(t *testing.T) {
+	file := writeTestLog(t, testRecords)
+	defer os.Remove(file.Name())
+	file.Close()
+
+	//the length of the first record now runs past the end of the log, over the records after it
+	data, _ := ioutil.ReadFile(file.Name())
+	data[6] ^= 0x01
+	records, err := readTestLog(t, file.Name())
+	if err != nil || len(records) != len(testRecords) {
+		t.Fatalf("failed to read the log before damaging it, got %d records and %v", len(records), err)
+	}
+	ioutil.WriteFile(file.Name(), data, os.ModePerm)
+	if records, err := readTestLog(t, file.Name()); err != ErrCorrupt {
+		t.Errorf("expected %v, got %d records and %v", ErrCorrupt, len(records), err)
+	}
+}
+
+func TestReader_BadLength(t *testing.T) {
+	//a length which would wrap around once the type is added
+	header := []byte{0, 0, 0, 0, 0xff, 0xff, 0xff, 0xff, 1}
+	if _, err := NewReader(bytes.NewReader(header)).Next(); err != ErrCorrupt {
+		t.Errorf("expected %v, got %v", ErrCorrupt, err)
+	}
+	header[7] = 0x7f
+	if _, err := NewReader(bytes.NewReader(header)).Next(); err != ErrCorrupt {
+		t.Errorf("expected %v for a length larger than the largest record, got %v", ErrCorrupt, err)
+	}
+}
+
+func TestWriter_RecordTooLarge(t *testing.T) {
+	file := writeTestLog(t, nil)
+	defer os.Remove(file.Name())
+	defer file.Close()
+	w := NewWriter(file)
+	large := Record{Type: TypePut, Key: []byte("key"), Value: make([]byte, MaxRecordSize)}
+	if err := w.Append(testRecords[0], large); err != ErrRecordTooLarge {
+		t.Errorf("expected %v, got %v", ErrRecordTooLarge, err)
+	}
+	if stat, _ := file.Stat(); stat.Size() != 0 {
+		t.Errorf("expected nothing to be written, got %d bytes", stat.Size())
+	}
+}
+
+func TestReader_Batch(t *testing.T) {
+	batch := NewBatchRecord(testRecords)
+	file := writeTestLog(t, []Record{testRecords[2], batch})
+	defer os.Remove(file.Name())
+	stat, _ := file.Stat()
+	file.Close()
+
+	records, err := readTestLog(t, file.Name())
+	if err != nil {
+		t.Fatal("failed to read records", err)
+	}
+	if len(records) != 1+len(testRecords) {
+		t.Fatalf("expected %d records, got %d", 1+len(testRecords), len(records))
+	}
+	for i, r := range records[1:] {
+		if r.Type != testRecords[i].Type || !bytes.Equal(r.Key, testRecords[i].Key) ||
+			!bytes.Equal(r.Value, testRecords[i].Value) {
+			t.Errorf("expected %v, got %v", testRecords[i], r)
+		}
+	}
+
+	os.Truncate(file.Name(), stat.Size()-1)
+	records, err = readTestLog(t, file.Name())
+	if err != nil || len(records) != 1 {
+		t.Errorf("torn batch should not be read, got %d records and %v", len(records), err)
+	}
+}
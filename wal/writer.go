@@ -0,0 +1,105 @@
+/*
+ * //  Licensed under the Apache License, Version 2.0 (the "License");
+ * //  you may not use this file except in compliance with the
+ * //  License. You may obtain a copy of the License at
+ * //    http://www.apache.org/licenses/LICENSE-2.0
+ * //  Unless required by applicable law or agreed to in writing,
+ * //  software distributed under the License is distributed on an "AS
+ * //  IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either
+ * //  express or implied. See the License for the specific language
+ * //  governing permissions and limitations under the License.
+ */
+
+
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"os"
+)
+
+/*
+Writer appends records to a write ahead log file.
+ */
+type Writer struct {
+	file *os.File
+	buf  []byte
+}
+
+/*
+Append encodes the records and writes them to the log with a single write. Nothing is written if the
+payload of one of the records is larger than MaxRecordSize.
+ */
+func (w *Writer) Append(records ...Record) error {
+	w.buf = w.buf[:0]
+	for _, r := range records {
+		start := len(w.buf)
+		w.buf = appendRecord(w.buf, r)
+		if len(w.buf)-start-headerSize > MaxRecordSize {
+			w.buf = w.buf[:0]
+			return ErrRecordTooLarge
+		}
+	}
+	_, err := w.file.Write(w.buf)
+	return err
+}
+
+/*
+Put appends a record setting the value of the key.
+ */
+func (w *Writer) Put(key, value []byte) error {
+	return w.Append(Record{Type: TypePut, Key: key, Value: value})
+}
+
+/*
+Delete appends a record deleting the key.
+ */
+func (w *Writer) Delete(key []byte) error {
+	return w.Append(Record{Type: TypeDelete, Key: key})
+}
+
+/*
+Sync commits the contents of the log to stable storage.
+ */
+func (w *Writer) Sync() error {
+	return w.file.Sync()
+}
+
+/*
+Close closes the underlying log file.
+ */
+func (w *Writer) Close() error {
+	return w.file.Close()
+}
+
+func appendRecord(dst []byte, r Record) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	start := len(dst)
+	dst = append(dst, make([]byte, headerSize)...)
+	dst[start+8] = byte(r.Type)
+	switch r.Type {
+	case TypePut:
+		n := binary.PutUvarint(tmp[:], uint64(len(r.Key)))
+		dst = append(dst, tmp[:n]...)
+		dst = append(dst, r.Key...)
+		dst = append(dst, r.Value...)
+	case TypeDelete:
+		dst = append(dst, r.Key...)
+	case TypeBatch:
+		dst = append(dst, r.Value...)
+	}
+	binary.LittleEndian.PutUint32(dst[start+4:], uint32(len(dst)-start-headerSize))
+	binary.LittleEndian.PutUint32(dst[start:], crc32.Checksum(dst[start+8:], crcTable))
+	return dst
+}
+
+/*
+NewWriter returns a Writer appending to the file. The file should be opened in append mode.
+ */
+func NewWriter(file *os.File) *Writer {
+	return &Writer{
+		file: file,
+		buf:  make([]byte, 0),
+	}
+}
@@ -15,18 +15,21 @@ package gokvstore
 import (
 	"bufio"
 	"encoding/binary"
+	"hash"
+	"hash/crc32"
 	"io"
 	"os"
-
-	"bytes"
-	"encoding/gob"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/tylertreat/BoomFilters"
 )
 
 const (
 	//blockSize is the default block size is the SSTable
 	blockSize = 4096
+	//filterFalsePositiveRate is the target false positive rate of the bloom filter of an SSTable
+	filterFalsePositiveRate = 0.0001
 )
 
 func encodeBlockInfo(dst []byte, b blockInfo) int {
@@ -34,12 +37,18 @@ func encodeBlockInfo(dst []byte, b blockInfo) int {
 	m := binary.PutUvarint(dst[n:], b.length)
 	return n + m
 }
+
 /*
-index contains the key and the offset of the key in the SSTable.
+appendIndexEntry appends the index entry of a block to dst. An entry is the length of the last key of the
+block as a uvarint, the last key, and the block info.
  */
-type index struct {
-	Key       []byte
-	KeyOffset uint64
+func appendIndexEntry(dst []byte, lastKey []byte, b blockInfo) []byte {
+	var tmp [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], uint64(len(lastKey)))
+	dst = append(dst, tmp[:n]...)
+	dst = append(dst, lastKey...)
+	n = encodeBlockInfo(tmp[:], b)
+	return append(dst, tmp[:n]...)
 }
 /*
 blockInfo maintains the block start offset for a block in the data file,
@@ -52,7 +61,9 @@ type blockInfo struct {
 
 /*
 Writer is used to create a new SSTable. It writes the contents of the data file and the
-meta file to disk.
+meta file to disk. The meta file holds a sparse index, with an entry per block of the data file, followed by
+the properties of the SSTable and a footer recording the format version. An SSTable written as a single
+file holds the data blocks followed by the filter and the contents of the meta file.
  */
 type Writer struct {
 	dataFile             *os.File
@@ -62,41 +73,45 @@ type Writer struct {
 	bufferedWriter       *bufio.Writer
 	metaWriter           io.Writer
 	bufferedMetaWriter   *bufio.Writer
+	metaCRC              hash.Hash32
 	filterWriter         io.Writer
 	bufferedFilterWriter *bufio.Writer
-	numEntries           int
+	filter               *boom.ScalableBloomFilter
+	block                *blockBuilder
 	offset               uint64
-	keyOffset            uint64
 	current              blockInfo
-	keyIndex             []index
-	blocks               []blockInfo
-	buf                  []byte
+	index                []byte
+	numBlocks            int
+	props                TableProperties
 	err                  error
-	tmp                  [50]byte
-	compress             bool
+	compression          Compression
+	level                int
+	//dir is the directory of the SSTable, synced once the SSTable is written
+	dir                  string
+	//path and tmpPath are set when the SSTable is written as a single file, which is renamed from tmpPath to
+	//path once complete
+	path                 string
+	tmpPath              string
 }
 /*
-Set writes a key value pair to the data file and writes the offset to the meta file.
+Set writes a key value pair to the data file. Keys must be set in ascending order. The key is added
+to the bloom filter of the SSTable, and stored in the current block without the prefix it shares with
+the previous key.
  */
 func (w *Writer) Set(key, value []byte) error {
 	if w.err != nil {
 		return w.err
 	}
-	idx := index{
-		key,
-		w.keyOffset,
+	w.filter.Add(key)
+	if w.props.NumEntries == 0 {
+		w.props.MinKey = append([]byte(nil), key...)
 	}
-	w.keyIndex = append(w.keyIndex, idx)
-
-	w.keyOffset += uint64(len(key) + len(value))
-	n := binary.PutUvarint(w.tmp[0:], uint64(len(key)))
-	n += binary.PutUvarint(w.tmp[n:], uint64(len(value)))
-	w.buf = append(w.buf, w.tmp[:n]...)
-	w.buf = append(w.buf, key...)
-
-	w.buf = append(w.buf, value...)
-	w.numEntries++
-	if len(w.buf) >= blockSize {
+	w.props.NumEntries++
+	if isTombstone(value) {
+		w.props.NumTombstones++
+	}
+	w.block.add(key, value)
+	if w.block.size() >= blockSize {
 		bi, err := w.finishBlock()
 		if err != nil {
 			w.err = err
@@ -109,48 +124,60 @@ func (w *Writer) Set(key, value []byte) error {
 }
 
 func (w *Writer) finishBlock() (blockInfo, error) {
-	b := w.buf
-	//if w.compress {
-	//	b = snappy.Encode(b, w.buf)
-	//}
+	raw := w.block.finish()
+	b, err := encodeBlock(raw, w.compression, w.level)
+	if err != nil {
+		return blockInfo{}, err
+	}
 
 	if _, err := w.writer.Write(b); err != nil {
 		return blockInfo{}, err
 	}
 	bh := blockInfo{w.offset, uint64(len(b))}
 	w.offset += uint64(len(b))
-	w.blocks = append(w.blocks, bh)
-	w.buf = w.buf[:0]
-	w.numEntries = 0
+	w.index = appendIndexEntry(w.index, w.block.lastKey, bh)
+	w.numBlocks++
+	w.props.RawSize += uint64(len(raw))
+	w.props.MaxKey = append(w.props.MaxKey[:0], w.block.lastKey...)
+	w.block.reset()
 
 	return bh, nil
 
 }
 /*
-Close closes the writer and flushes the contents of the data file writer
-and meta file writer to disk.
+Close closes the writer and flushes the contents of the data file writer,
+meta file writer and filter file writer to disk. The files and their directory are synced, so that the
+SSTable is durable before the write ahead log or the SSTables it was compacted from are deleted. An SSTable
+written as a single file is renamed into place once all of it is on disk, so that an SSTable which is not
+complete is never read.
  */
 func (w *Writer) Close() (err error) {
 	defer func() {
-		if w.dataFile == nil && w.metaFile == nil {
+		if w.dataFile == nil && w.metaFile == nil && w.filterFile == nil {
 			return
 		}
-		err1 := w.dataFile.Close()
-		if err == nil {
-			err = err1
+		for _, f := range []**os.File{&w.dataFile, &w.metaFile, &w.filterFile} {
+			if *f == nil {
+				continue
+			}
+			if cerr := (*f).Close(); cerr != nil && err == nil {
+				err = cerr
+			}
+			*f = nil
+		}
+		if err == nil && w.tmpPath != "" {
+			err = errors.Wrap(os.Rename(w.tmpPath, w.path), "failed to rename the sstable")
 		}
-		w.dataFile = nil
-		err1 = w.metaFile.Close()
-		if err == nil {
-			err = err1
+		if err == nil && w.dir != "" {
+			//the entries of the new files, or the new name of the single file, are durable once the directory is synced
+			err = errors.Wrap(syncDir(w.dir), "failed to sync the sstable directory")
 		}
-		w.metaFile = nil
 	}()
 	if w.err != nil {
 		return w.err
 	}
 
-	if w.numEntries > 0 || len(w.keyIndex) == 0 {
+	if !w.block.empty() {
 		bh, err := w.finishBlock()
 		if err != nil {
 			w.err = err
@@ -159,108 +186,115 @@ func (w *Writer) Close() (err error) {
 		w.current = bh
 	}
 
-	err, n := w.writeIndex()
+	f := footer{numBlocks: uint32(w.numBlocks)}
+	if w.tmpPath != "" {
+		//the metadata follows the data blocks, starting with the filter
+		f.metaOffset = w.offset
+	}
+	n, err := w.filter.WriteTo(w.filterWriter)
 	if err != nil {
+		w.err = err
+		return errors.Wrap(err, "failed to write the filter")
+	}
+	if w.tmpPath != "" {
+		f.filterLength = uint64(n)
+	}
+	if _, err := w.metaWriter.Write(w.index); err != nil {
 		w.err = err
 		return errors.Wrap(err, "failed to write the index")
 	}
-	err = w.writeBlocks()
-
-	if err != nil {
+	f.propsOffset = f.metaOffset + f.filterLength + uint64(len(w.index))
+	w.props.DataSize = w.offset
+	w.props.CreationTime = time.Now()
+	if w.props.NumTombstones > 0 && w.props.DeletionTime.IsZero() {
+		//the keys were deleted before they were written
+		w.props.DeletionTime = w.props.CreationTime
+	}
+	if _, err := w.metaWriter.Write(w.props.encode()); err != nil {
 		w.err = err
-		return errors.Wrap(err, "failed to write the block info")
+		return errors.Wrap(err, "failed to write the properties")
 	}
-	err = w.writeFooter(n)
+	err = w.writeFooter(f)
 	if err != nil {
 		w.err = err
 		return errors.Wrap(err, "failed to write the footer")
 	}
 
-	if w.bufferedWriter != nil {
-		if err := w.bufferedWriter.Flush(); err != nil {
+	for _, b := range []*bufio.Writer{w.bufferedWriter, w.bufferedMetaWriter, w.bufferedFilterWriter} {
+		if err := b.Flush(); err != nil {
 			w.err = err
 			return err
 		}
 	}
-	if w.bufferedMetaWriter != nil {
-		if err := w.bufferedMetaWriter.Flush(); err != nil {
+	for _, f := range []*os.File{w.dataFile, w.metaFile, w.filterFile} {
+		if f == nil {
+			continue
+		}
+		if err := f.Sync(); err != nil {
 			w.err = err
-			return err
+			return errors.Wrap(err, "failed to sync the sstable")
 		}
 	}
 
 	return nil
 }
 
-func (w *Writer) writeIndex() (error, int) {
-
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	err := enc.Encode(w.keyIndex)
-	if err != nil {
-		w.err = err
-		return errors.Wrap(err, "failed to encode the keyIndex"), 0
-	}
-	n, err := w.metaWriter.Write(buf.Bytes())
-	if err != nil {
-		w.err = err
-		return errors.Wrap(err, "failed to write keyIndex"), 0
-	}
-	return nil, n
-}
-
-func (w *Writer) writeBlocks() error {
-	var enc [10]byte
-	tmp := make([]byte, 0)
-	for _, bi := range w.blocks {
-		n := encodeBlockInfo(enc[:], bi)
-		tmp = append(tmp, enc[:n]...)
-	}
-	_, err := w.metaWriter.Write(tmp[0:])
-	if err != nil {
+func (w *Writer) writeFooter(f footer) error {
+	b := f.encode()
+	if _, err := w.metaWriter.Write(b[:footerSize-12]); err != nil {
 		w.err = err
-		return errors.Wrap(err, "failed to write block indexes")
+		return w.err
 	}
-
-	return nil
-}
-
-func (w *Writer) writeFooter(n int) error {
-
-	footer := w.tmp[:4]
-	binary.PutUvarint(w.tmp[0:], uint64(n))
-	if _, err := w.metaWriter.Write(footer); err != nil {
+	//the checksum covers everything written to the metadata before it
+	binary.LittleEndian.PutUint32(b[footerSize-12:], w.metaCRC.Sum32())
+	if _, err := w.bufferedMetaWriter.Write(b[footerSize-12:]); err != nil {
 		w.err = err
 		return w.err
 	}
 	return nil
 }
 /*
-NewWriter is used to create a new Writer for a SSTable. It initializes the io.Writer and
-the bufio.Writer for the data file and the meta file. If compress is true, the contents of each block
+NewWriter is used to create a new Writer for a SSTable. If compress is true, the contents of each block
 are compressed using snappy compression before being written to disk.
  */
 func NewWriter(sst *SSTable, compress bool) *Writer {
-	keyIndex := make([]index, 0)
-	blocks := make([]blockInfo, 0)
-	buf := make([]byte, 0)
+	return NewWriterWithOptions(sst, &Options{UseCompression: compress})
+}
 
+/*
+NewWriterWithOptions is used to create a new Writer for a SSTable. It initializes the io.Writer and
+the bufio.Writer for the data file, the meta file and the filter file, or for the single file of the SSTable. The contents of each block are compressed using
+the codec selected by the options before being written to disk, unless compression does not save enough
+space for that block. Each block ends with a trailer recording how it was written.
+ */
+func NewWriterWithOptions(sst *SSTable, options *Options) *Writer {
 	w := &Writer{
-		numEntries: 0,
-		offset:     0,
-		keyOffset:  0,
-		keyIndex:   keyIndex,
-		blocks:     blocks,
-		buf:        buf,
-		dataFile:   sst.datafile,
-		metaFile:   sst.metafile,
-		filterFile: sst.filterfile,
-		compress:   compress,
+		block:       newBlockBuilder(),
+		offset:      0,
+		dataFile:    sst.datafile,
+		metaFile:    sst.metafile,
+		filterFile:  sst.filterfile,
+		compression: options.compression(),
+		level:       options.CompressionLevel,
+		dir:         sst.dir,
 	}
+	w.props.Compression = w.compression
 	w.bufferedWriter = bufio.NewWriter(w.dataFile)
-	w.bufferedMetaWriter = bufio.NewWriter(w.metaFile)
-
+	w.filter = boom.NewDefaultScalableBloomFilter(filterFalsePositiveRate)
 	w.writer = w.bufferedWriter
-	w.metaWriter = w.bufferedMetaWriter
+	w.metaCRC = crc32.New(crcTable)
+	if sst.singleFile() {
+		//the filter, the index and the properties follow the data blocks in the same file
+		w.path, w.tmpPath = sst.path, sst.tmpPath
+		w.bufferedMetaWriter = w.bufferedWriter
+		w.bufferedFilterWriter = w.bufferedWriter
+		w.metaWriter = io.MultiWriter(w.bufferedMetaWriter, w.metaCRC)
+		w.filterWriter = w.metaWriter
+		return w
+	}
+	w.bufferedMetaWriter = bufio.NewWriter(w.metaFile)
+	w.bufferedFilterWriter = bufio.NewWriter(w.filterFile)
+	w.metaWriter = io.MultiWriter(w.bufferedMetaWriter, w.metaCRC)
+	w.filterWriter = w.bufferedFilterWriter
 	return w
 }